@@ -0,0 +1,20 @@
+package tcache
+
+// like Get, but for caches created WithArgFetch. A miss is fetched with the
+// fetch given to WithArgFetch, which also gets arg. arg isn't part of the
+// cache key, the value is cached under key alone and every get of key shares
+// it and its single-flight whatever their arg, so key must already include
+// anything in arg that changes the result, eg. "tenant/id" rather than "id"
+func (m *Cache) GetWithArg(key string, arg interface{}) (value interface{}, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	if m.argFetch == nil {
+		err = ErrNoArgFetch
+		return
+	}
+	e, _, err := m.doFetch(key, false, func(key string) (interface{}, error) {
+		return m.argFetch(key, arg)
+	})
+	return m.copyValue(e.value), err
+}
@@ -0,0 +1,40 @@
+package tcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGetWithArg(t *testing.T) {
+	type tenant struct {
+		id string
+	}
+	var fetched []string
+	cache, _ := New(getMd5Value, WithArgFetch(func(key string, arg interface{}) (interface{}, error) {
+		fetched = append(fetched, key)
+		return fmt.Sprintf("%s for %s", key, arg.(tenant).id), nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		value, err := cache.GetWithArg("a/1", tenant{"a"})
+		if err != nil || value != "a/1 for a" {
+			t.Fatalf("value: %v, error: %v, want a/1 for a", value, err)
+		}
+	}
+	if len(fetched) != 1 {
+		t.Fatalf("fetched: %v, want a/1 once", fetched)
+	}
+
+	// arg isn't part of the key
+	if value, _ := cache.GetWithArg("a/1", tenant{"b"}); value != "a/1 for a" {
+		t.Fatalf("value: %v, want the value cached for a/1", value)
+	}
+	if value, _ := cache.Get("2"); !checkKey("2", value.(string)) {
+		t.Fatalf("value: %v, Get still uses the fetch passed to New", value)
+	}
+
+	cache, _ = New(getMd5Value)
+	if _, err := cache.GetWithArg("1", nil); err != ErrNoArgFetch {
+		t.Fatalf("error: %v, want %v", err, ErrNoArgFetch)
+	}
+}
@@ -0,0 +1,100 @@
+package tcache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// backoff keeps track of the keys whose fetches keep failing, see
+// WithErrorBackoff
+type backoff struct {
+	lock     sync.Mutex
+	base     time.Duration
+	max      time.Duration
+	failures map[string]*failure
+	sweepAt  int // len(failures) at which record next sweeps them
+}
+
+// minSweep is the fewest failures record sweeps
+const minSweep = 64
+
+// failure is a key that's backing off
+type failure struct {
+	count int       // consecutive failed fetches
+	err   error     // returned by the last one
+	until time.Time // gets don't fetch the key before then
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	if max < base {
+		max = base
+	}
+	return &backoff{
+		base:     base,
+		max:      max,
+		failures: make(map[string]*failure),
+		sweepAt:  minSweep,
+	}
+}
+
+// check returns the error of the last fetch of key if key is still backing
+// off at now
+func (b *backoff) check(key string, now time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	f, ok := b.failures[key]
+	if !ok || !now.Before(f.until) {
+		return nil
+	}
+	return f.err
+}
+
+// record notes how a fetch of key that ended at now went, backing off for
+// twice as long as last time if it failed again and forgetting about key if
+// it didn't. A key failing again more than max after its backoff ended
+// starts over at base. Keys that stop failing because they aren't fetched
+// anymore are swept every time the failures have doubled since the last
+// sweep
+func (b *backoff) record(key string, err error, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil || errors.Is(err, ErrSkipCache) {
+		delete(b.failures, key)
+		return
+	}
+	f, ok := b.failures[key]
+	if !ok && len(b.failures) >= b.sweepAt {
+		b.sweep(now)
+	}
+	if !ok || f.stale(now, b.max) {
+		f = &failure{}
+		b.failures[key] = f
+	}
+	f.count++
+	f.err = err
+	delay := b.max
+	if f.count < 32 && b.base<<uint(f.count-1) < b.max {
+		delay = b.base << uint(f.count-1)
+	}
+	f.until = now.Add(delay)
+}
+
+// stale reports whether f ended long enough before now to be forgotten
+func (f *failure) stale(now time.Time, max time.Duration) bool {
+	return now.After(f.until.Add(max))
+}
+
+// sweep forgets the keys that are stale, which would start over at base
+// anyway the next time they fail. Must be called with lock held
+func (b *backoff) sweep(now time.Time) {
+	for key, f := range b.failures {
+		if f.stale(now, b.max) {
+			delete(b.failures, key)
+		}
+	}
+	b.sweepAt = 2 * len(b.failures)
+	if b.sweepAt < minSweep {
+		b.sweepAt = minSweep
+	}
+}
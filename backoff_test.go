@@ -0,0 +1,72 @@
+package tcache
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestErrorBackoff(t *testing.T) {
+	testErr := errors.New("error")
+	var calls int
+	fail := true
+	now := time.Now()
+	cache, _ := New(func(key string) (interface{}, error) {
+		calls++
+		if fail {
+			return nil, testErr
+		}
+		return key, nil
+	}, WithErrorBackoff(time.Second, 3*time.Second))
+	cache.now = func() time.Time { return now }
+	get := func(wantCalls int) {
+		t.Helper()
+		if _, err := cache.Get("1"); !errors.Is(err, testErr) || calls != wantCalls {
+			t.Fatalf("error: %v, calls: %d, want %v after %d calls", err, calls, testErr, wantCalls)
+		}
+	}
+
+	get(1)
+	get(1)
+	now = now.Add(time.Second)
+	get(2)
+	// backing off for twice as long now, and at most 3s
+	now = now.Add(time.Second)
+	get(2)
+	now = now.Add(time.Second)
+	get(3)
+	now = now.Add(3 * time.Second)
+	get(4)
+
+	// Refresh still fetches, and a success ends the backoff
+	fail = false
+	if value, err := cache.Refresh("1"); err != nil || value != "1" {
+		t.Fatalf("value: %v, error: %v, want 1, nil", value, err)
+	}
+	cache.Delete("1")
+	if value, err := cache.Get("1"); err != nil || value != "1" || calls != 6 {
+		t.Fatalf("value: %v, error: %v, calls: %d, want 1 fetched again", value, err, calls)
+	}
+}
+
+func TestErrorBackoffSweep(t *testing.T) {
+	testErr := errors.New("error")
+	b := newBackoff(time.Second, 3*time.Second)
+	now := time.Now()
+	for i := 0; i < 1024; i++ {
+		b.record(strconv.Itoa(i), testErr, now)
+	}
+	// keys that never fail again are swept once max has passed after
+	// their backoff, the next time the failures have doubled
+	now = now.Add(7 * time.Second)
+	b.record("new", testErr, now)
+	if n := len(b.failures); n != 1 {
+		t.Fatalf("failures: %d, want only the new one", n)
+	}
+	// and a key failing again that late starts over
+	b.record("0", testErr, now)
+	if f := b.failures["0"]; f.count != 1 || !f.until.Equal(now.Add(time.Second)) {
+		t.Fatalf("failure: %+v, want backing off for 1s again", f)
+	}
+}
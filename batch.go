@@ -0,0 +1,117 @@
+package tcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// getManyParallelism bounds how many fetches a single GetMany runs at once
+const getManyParallelism = 16
+
+// gets every key in keys, fetching the missing ones concurrently. Duplicate
+// keys are only fetched once and keys that are already being fetched by
+// someone else, another GetMany included, share that fetch since every key
+// goes through the same single-flight as Get. Cached keys are served without
+// fetching.
+// The returned map holds every key that could be gotten, err is the first
+// fetch error encountered, if any
+func (m *Cache) GetMany(keys []string) (values map[string]interface{}, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	values = make(map[string]interface{}, len(keys))
+	missing := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		e, ok := m.shardFor(key).lookup(key)
+		if ok {
+			m.count(&m.stats.hits)
+			values[key] = m.copyValue(e.value)
+			if e.stale(m.now()) {
+				m.refreshInBackground(key)
+			}
+		} else {
+			missing = append(missing, key)
+		}
+	}
+
+	m.getConcurrently(missing, func(key string, value interface{}, getErr error) {
+		if getErr != nil {
+			if err == nil {
+				err = getErr
+			}
+			return
+		}
+		values[key] = value
+	})
+	return
+}
+
+// getConcurrently gets every key in keys, at most getManyParallelism at once,
+// and hands each result to got. got is never called concurrently
+func (m *Cache) getConcurrently(keys []string, got func(key string, value interface{}, err error)) {
+	var lock sync.Mutex
+	wg := &sync.WaitGroup{}
+	sem := make(chan struct{}, getManyParallelism)
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			value, err := m.Get(key)
+			lock.Lock()
+			defer lock.Unlock()
+			got(key, value, err)
+		}(key)
+	}
+	wg.Wait()
+}
+
+// warm gets every key given to WithWarmKeys, returning all of the fetch
+// errors joined together
+func (m *Cache) warm() (err error) {
+	var errs []error
+	done := 0
+	m.getConcurrently(m.warmKeys, func(key string, value interface{}, getErr error) {
+		if getErr != nil {
+			errs = append(errs, fmt.Errorf("warming %s: %w", key, getErr))
+		}
+		done++
+		if m.warmProgress != nil {
+			m.warmProgress(done, len(m.warmKeys))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// blocks until the keys given to WithWarmKeys are warmed, eg. to hold back a
+// readiness probe, and returns what New would have returned if it had waited.
+// Only caches created WithWarmInBackground ever wait, otherwise New already
+// did. Gives up with ctx's error once ctx is done
+func (m *Cache) WaitWarm(ctx context.Context) error {
+	if m.warmed == nil {
+		return m.warmErr
+	}
+	select {
+	case <-m.warmed:
+		return m.warmErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sets every key in values at once, with all of the shards locked so readers
+// never see half of the batch. Items get the default ttl and, like Set, win
+// over any fetch for their key that's in flight
+func (m *Cache) SetMany(values map[string]interface{}) (err error) {
+	return m.merge(values)
+}
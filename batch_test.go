@@ -0,0 +1,207 @@
+package tcache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetMany(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm), WithStats())
+	keys := []string{"1", "2", "11", "12", "11", "12", "1"}
+	values, err := cache.GetMany(keys)
+	if err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if len(values) != 4 {
+		t.Fatalf("len: %d, want 4", len(values))
+	}
+	for k, v := range values {
+		if !checkKey(k, v.(string)) {
+			t.Fatalf("key %s, value %v, want %s", k, v, computeMD5(k))
+		}
+	}
+	// only the 2 missing keys were fetched, once each
+	if stats := cache.Stats(); stats.Fetches != 2 || stats.Hits != 2 {
+		t.Fatalf("stats: %+v, want 2 fetches and 2 hits", stats)
+	}
+
+	// the fetches run concurrently
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	cache, _ = New(func(key string) (interface{}, error) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return computeMD5(key), nil
+	})
+	keys = keys[:0]
+	for i := 0; i < 100; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	if values, _ := cache.GetMany(keys); len(values) != 100 {
+		t.Fatalf("len: %d, want 100", len(values))
+	}
+	if maxRunning < 2 || maxRunning > getManyParallelism {
+		t.Fatalf("concurrent fetches: %d, want between 2 and %d", maxRunning, getManyParallelism)
+	}
+
+	// failed keys are left out and the error is returned
+	testErr := errors.New("error")
+	cache, _ = New(func(key string) (interface{}, error) {
+		if key == "2" {
+			return nil, testErr
+		}
+		return computeMD5(key), nil
+	})
+	values, err = cache.GetMany([]string{"1", "2", "3"})
+	if !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+	if _, ok := values["2"]; ok || len(values) != 2 {
+		t.Fatalf("values: %v, want 1 and 3", values)
+	}
+
+	cache = &Cache{}
+	if _, err := cache.GetMany([]string{"1"}); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestGetManyOverlapping(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return computeMD5(key), nil
+	}, WithStats())
+
+	// b and c are fetched once for both batches, whichever gets them first
+	wg := &sync.WaitGroup{}
+	for _, keys := range [][]string{{"a", "b", "c"}, {"b", "c", "d"}} {
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			values, err := cache.GetMany(keys)
+			if err != nil || len(values) != 3 {
+				t.Errorf("values: %v, error: %v, want all of %v", values, err, keys)
+			}
+		}(keys)
+	}
+	for atomic.LoadInt64(&calls) != 4 || cache.Stats().HerdWaits != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 4 {
+		t.Fatalf("calls: %d, want one per distinct key", calls)
+	}
+}
+
+func TestSetMany(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+	if err := cache.SetMany(create1To10MD5Map()); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if !reflect.DeepEqual(cache.Snapshot(), create1To10MD5Map()) {
+		t.Fatalf("items: %v, want 1 to 10", cache.Snapshot())
+	}
+	if _, expiresAt, _ := cache.GetWithExpiry("1"); !expiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expires at: %v, want the default ttl", expiresAt)
+	}
+
+	cache = &Cache{}
+	if err := cache.SetMany(create1To10MD5Map()); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestWarmKeys(t *testing.T) {
+	testErr := errors.New("error")
+	cache, err := New(func(key string) (interface{}, error) {
+		if key == "2" || key == "4" {
+			return nil, testErr
+		}
+		return computeMD5(key), nil
+	}, WithWarmKeys([]string{"1", "2", "3", "4"}))
+	if cache == nil || !errors.Is(err, testErr) {
+		t.Fatalf("cache: %v, error: %v, want a cache and %v", cache, err, testErr)
+	}
+	if !strings.Contains(err.Error(), "warming 2") || !strings.Contains(err.Error(), "warming 4") {
+		t.Fatalf("error: %v, want both failed keys", err)
+	}
+	if keys := cache.Keys(); len(keys) != 2 || !cache.Has("1") || !cache.Has("3") {
+		t.Fatalf("keys: %v, want 1 and 3 warmed", keys)
+	}
+
+	if err := cache.WaitWarm(context.Background()); !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+	if _, err := New(getMd5Value, WithWarmKeys([]string{"1"})); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+}
+
+func TestWarmProgress(t *testing.T) {
+	var progress []int
+	keys := []string{"1", "2", "3", "4", "5"}
+	New(getMd5Value, WithWarmKeys(keys), WithWarmProgress(func(done, total int) {
+		if total != len(keys) {
+			t.Errorf("total: %d, want %d", total, len(keys))
+		}
+		progress = append(progress, done)
+	}))
+	if !reflect.DeepEqual(progress, []int{1, 2, 3, 4, 5}) {
+		t.Fatalf("progress: %v, want every key counted once", progress)
+	}
+}
+
+func TestWarmInBackground(t *testing.T) {
+	testErr := errors.New("error")
+	release := make(chan struct{})
+	cache, err := New(func(key string) (interface{}, error) {
+		<-release
+		if key == "2" {
+			return nil, testErr
+		}
+		return computeMD5(key), nil
+	}, WithWarmKeys([]string{"1", "2"}), WithWarmInBackground())
+	if err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := cache.WaitWarm(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("error: %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err := cache.WaitWarm(context.Background()); !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+	if !cache.Has("1") {
+		t.Fatal("1 should have been warmed")
+	}
+
+	// nothing to wait for without warm keys
+	cache, _ = New(getMd5Value, WithWarmInBackground())
+	if err := cache.WaitWarm(context.Background()); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+}
@@ -1,48 +1,169 @@
 package tcache
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	ErrNotInitialized = errors.New("initialize the cache by calling New, not creating an empty struct")
+	ErrFetchPanicked  = errors.New("fetch panicked")
+	ErrFetchTimeout   = errors.New("fetch timed out")
+	ErrReentrantFetch = errors.New("fetch got its own key, which would deadlock")
+	ErrClosed         = errors.New("cache is closed")
+	ErrNoKeyFunc      = errors.New("GetKey needs a cache created WithKeyFunc")
+	ErrNoArgFetch     = errors.New("GetWithArg needs a cache created WithArgFetch")
+	ErrPublished      = errors.New("an expvar with that name is already published")
+	ErrHerdTimeout    = errors.New("gave up waiting on another get's fetch")
+	ErrTypeMismatch   = errors.New("cached value has a different type")
+
+	// fetch returns ErrSkipCache, wrapped or not, along with a value that
+	// shouldn't be cached, eg. a placeholder for an upstream that's down.
+	// The value is handed to the gets waiting on the fetch with a nil
+	// error, but the next get fetches the key again
+	ErrSkipCache = errors.New("don't cache this value")
 )
 
+// FetchError is what Get and friends return when fetch fails, telling which
+// key it failed for. errors.Is and errors.As see through it to Err, the error
+// fetch returned
+type FetchError struct {
+	Key string
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("fetching %s: %v", e.Key, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
 type Cache struct {
-	items              map[string]interface{}
-	itemsLock          sync.RWMutex
-	fetch              func(key string) (interface{}, error)
-	isBeingFetchedMap  map[string]bool
-	isBeingFetchedLock sync.RWMutex
-	isBeingFetchedWG   map[string]*sync.WaitGroup
-	preWarmInit        *func() (map[string]interface{}, error)
+	stats              counters
+	lastGen            uint64 // gen of the latest write, atomic
+	clears             uint64 // bumped by Clear and friends, atomic
+	statsEnabled       bool
+	name               string
+	shards             []*shard
+	shardCount         int
+	initialCapacity    int
+	fetch              atomic.Value  // func(key string) (interface{}, error), see currentFetch
+	calls              sync.Map      // key -> *call for every fetch in flight
+	fetchSem           chan struct{} // bounds concurrent fetches when not nil
+	noSingleFlight     bool
+	fetchTimeout       time.Duration
+	fetchObserver      func(key string, d time.Duration, err error)
+	logger             func(msg string, err error)
+	store              Store
+	conditionalFetch   func(key string, current interface{}) (interface{}, bool, error)
+	multiFetch         func(key string) (interface{}, map[string]interface{}, error)
+	transform          func(key string, value interface{}) (interface{}, error)
+	maxHerdWait        time.Duration
+	fetchOnHerdTimeout bool
+	reentrancyCheck    bool
+	updateDebounce     time.Duration
+	keepPrevious       time.Duration
+	limiter            *limiter // nil without WithFetchRateLimit
+	backoff            *backoff // nil without WithErrorBackoff
+	retryAttempts      int
+	retryBackoff       time.Duration
+	preWarmInit        func() (map[string]interface{}, error)
+	warmKeys           []string
+	warmInBackground   bool
+	warmProgress       func(done, total int)
+	warmed             chan struct{} // closed once warmErr is set, nil when warming in New
+	warmErr            error
+	copier             func(interface{}) interface{}
+	skipNil            bool // nil fetch results aren't stored
+	keyFunc            func(keyObj interface{}) string
+	keyFetch           func(keyObj interface{}) (interface{}, error)
+	argFetch           func(key string, arg interface{}) (interface{}, error)
+	ttl                time.Duration
+	softTTL            time.Duration
+	sliding            bool // hits extend the ttl, see WithSlidingExpiration
+	ttlJitter          float64
+	cleanupInterval    time.Duration
+	staleRetention     time.Duration // how long the janitor keeps expired items, see GetWithFallback
+
+	loopsLock  sync.Mutex
+	closed     int32    // set by Close, atomic
+	loops      []func() // stops every background goroutine
+	maxEntries int
+	maxBytes   int64
+	sizer      func(interface{}) int64
+	policy     EvictionPolicy
+	now        func() time.Time
+
+	generationLock sync.Mutex
+	previous       map[string]*entry // items before the last Clear, see WithPreviousGeneration
+	generation     int
+
+	debounceLock sync.Mutex
+	debounced    map[string]*debouncedUpdate
+
+	callbacksLock sync.RWMutex
+	onEvict       []func(key string, value interface{}, meta map[string]string)
+	evictObserver func(key string, value interface{}, reason EvictReason)
+	subscriptions []*subscription
+	onSet         []func(key string, value interface{}, meta map[string]string)
 }
 
-// Pass in the function that fetches the values when there's a cache miss
-func New(fetch func(string) (interface{}, error), preWarmInit *func() (map[string]interface{}, error)) (cache *Cache, err error) {
-	var items map[string]interface{}
+// Pass in the function that fetches the values when there's a cache miss,
+// followed by any options. New only fails without a cache when WithPreWarm
+// does, see WithWarmKeys for the other error. Unless WithValueCopier is
+// used, the values handed out are the cached ones, so mutating a returned
+// pointer, slice or map changes it for everyone using the cache
+func New(fetch func(string) (interface{}, error), opts ...Option) (cache *Cache, err error) {
+	cache = &Cache{
+		now: time.Now,
+	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	if cache.conditionalFetch != nil {
+		fetch = cache.fetchConditionally
+	}
+	if cache.multiFetch != nil {
+		fetch = cache.fetchMulti
+	}
+	cache.SetFetch(fetch)
+	cache.initShards()
 
 	// prewarm the cache if preWarmInit is defined
-	if preWarmInit != nil {
-		items, err = (*preWarmInit)()
+	if cache.preWarmInit != nil {
+		var items map[string]interface{}
+		items, err = cache.preWarmInit()
 		if err != nil {
+			cache = nil
 			return
 		}
+		for _, s := range cache.shards {
+			s.items = s.newItems(cache.perShard(len(items)))
+		}
+		for k, v := range items {
+			cache.shardFor(k).store(k, v)
+		}
 	}
-
-	// Initialize empty map without prewarming
-	if preWarmInit == nil {
-		items = make(map[string]interface{})
-	}
-
-	cache = &Cache{
-		items:             items,
-		fetch:             fetch,
-		isBeingFetchedMap: make(map[string]bool),
-		isBeingFetchedWG:  make(map[string]*sync.WaitGroup),
-		preWarmInit:       preWarmInit,
+	if len(cache.warmKeys) > 0 {
+		if cache.warmInBackground {
+			cache.warmed = make(chan struct{})
+			go func() {
+				cache.warmErr = cache.warm()
+				close(cache.warmed)
+			}()
+		} else {
+			cache.warmErr = cache.warm()
+			err = cache.warmErr
+		}
 	}
+	cache.startCleanup()
 	return
 }
 
@@ -52,129 +173,478 @@ func New(fetch func(string) (interface{}, error), preWarmInit *func() (map[strin
     stampede
 */
 func (m *Cache) Get(key string) (value interface{}, err error) {
-	var ok bool
-	m.itemsLock.RLock()
-	if m.items == nil {
-		m.itemsLock.RUnlock()
-		err = ErrNotInitialized
+	e, _, err := m.doFetch(key, false, m.currentFetch())
+	return m.copyValue(e.value), err
+}
+
+// like Get, but gives up once ctx is done, returning ctx's error. It shares
+// the single-flight with Get, so only waiting on another get's fetch of key
+// can be cut short. When this get is the one fetching, fetch doesn't see ctx
+// and runs to completion, see WithFetchTimeout to bound it
+func (m *Cache) GetContext(ctx context.Context, key string) (value interface{}, err error) {
+	if err = ctx.Err(); err != nil {
 		return
 	}
-	value, ok = m.items[key]
-	m.itemsLock.RUnlock()
+	e, _, err := m.doFetchContext(ctx, key, false, m.currentFetch())
+	return m.copyValue(e.value), err
+}
 
-	if !ok {
-		// check if it's already being fetched
-		m.isBeingFetchedLock.RLock()
-		beingFetched := m.isBeingFetchedMap[key]
-		m.isBeingFetchedLock.RUnlock()
+// like Get, but a miss is fetched with fetch instead of the cache's own fetch,
+// this once. It shares the single-flight with every other get of key, so if
+// key is already being fetched by some other fetch that's the one whose
+// value is returned, and the result is cached like any other. Keeping the
+// fetches used for a key consistent is up to the caller
+func (m *Cache) GetOrFetch(key string, fetch func(string) (interface{}, error)) (value interface{}, err error) {
+	e, _, err := m.doFetch(key, false, fetch)
+	return m.copyValue(e.value), err
+}
 
-		if !beingFetched {
-			m.isBeingFetchedLock.Lock()
-			m.isBeingFetchedMap[key] = true
-			wg := m.isBeingFetchedWG[key]
-			if wg == nil {
-				wg = &sync.WaitGroup{}
-				m.isBeingFetchedWG[key] = wg
-			}
-			wg.Add(1)
-			m.isBeingFetchedLock.Unlock()
-			defer wg.Done()
-
-			// fetch value
-			value, err = m.fetch(key)
-			if err != nil {
-				return
+// replaces the function fetching misses, eg. to fail over to another
+// backend, keeping everything that's cached. Fetches already running finish
+// with the old one. Values from either fetch end up side by side in the
+// cache, so they'd better be compatible. fetch replaces WithConditionalFetch
+// and WithMultiFetch too, misses are fetched by fetch alone from then on
+func (m *Cache) SetFetch(fetch func(string) (interface{}, error)) {
+	m.fetch.Store(fetch)
+}
+
+// currentFetch returns the fetch set by New or SetFetch. It's a plain atomic
+// load, so hits don't pay for fetches being swappable
+func (m *Cache) currentFetch() (fetch func(string) (interface{}, error)) {
+	fetch, _ = m.fetch.Load().(func(string) (interface{}, error))
+	return
+}
+
+// the name given with WithName, empty by default
+func (m *Cache) Name() string {
+	return m.name
+}
+
+// named prefixes err with the cache's name, if it has one, so errors from
+// several caches can be told apart. errors.Is still matches the wrapped err
+func (m *Cache) named(err error) error {
+	if m.name == "" {
+		return err
+	}
+	return fmt.Errorf("cache %q: %w", m.name, err)
+}
+
+// log reports what the cache did in the background to the logger from
+// WithLogger, if there is one
+func (m *Cache) log(msg string, err error) {
+	if m.logger != nil {
+		m.logger(msg, err)
+	}
+}
+
+// copyValue hands out a copy of value made by the copier, if there is one
+func (m *Cache) copyValue(value interface{}) interface{} {
+	if m.copier == nil || value == nil {
+		return value
+	}
+	return m.copier(value)
+}
+
+// lookup returns a copy of the entry for key if it's present and hasn't
+// expired. Hits only take the read lock unless they have to update the
+// eviction order or the expiry, so the hit path doesn't allocate and hits on
+// the hottest key of an lru don't contend
+func (s *shard) lookup(key string) (e entry, ok bool) {
+	s.itemsLock.RLock()
+	stored, ok := s.items[key]
+	if !ok || stored.expired(s.cache.now()) {
+		s.itemsLock.RUnlock()
+		ok = false
+		return
+	}
+	if !s.needsTouch(stored) {
+		e = *stored
+		s.itemsLock.RUnlock()
+		return
+	}
+	s.itemsLock.RUnlock()
+
+	// the entry may have changed while the lock was let go
+	s.itemsLock.Lock()
+	defer s.itemsLock.Unlock()
+	stored, ok = s.items[key]
+	if !ok || stored.expired(s.cache.now()) {
+		ok = false
+		return
+	}
+	s.touch(stored)
+	if s.cache.sliding {
+		s.cache.extend(stored)
+	}
+	e = *stored
+	return
+}
+
+// stops every background goroutine, the WithCleanupInterval janitor and any
+// StartRefresh loops, waiting for them to exit. Afterwards everything that
+// returns an error returns ErrClosed, reading what's cached still works. Safe
+// to call more than once
+func (m *Cache) Close() (err error) {
+	m.loopsLock.Lock()
+	if m.closed != 0 {
+		m.loopsLock.Unlock()
+		return
+	}
+	atomic.StoreInt32(&m.closed, 1)
+	loops := m.loops
+	m.loops = nil
+	m.loopsLock.Unlock()
+
+	for _, stop := range loops {
+		stop()
+	}
+	return
+}
+
+// reports whether the cache was created by New. The zero Cache isn't usable,
+// everything that returns an error returns ErrNotInitialized and the rest
+// does nothing. A closed cache is still initialized
+func (m *Cache) Initialized() bool {
+	return m.shards != nil
+}
+
+// usable returns why the cache can't be used, if it can't
+func (m *Cache) usable() (err error) {
+	switch {
+	case m.shards == nil:
+		err = ErrNotInitialized
+	case atomic.LoadInt32(&m.closed) != 0:
+		err = m.named(ErrClosed)
+	}
+	return
+}
+
+// track starts a background goroutine with every, making sure Close stops it.
+// Nothing is started on a closed cache
+func (m *Cache) track(interval time.Duration, tick func(done <-chan struct{})) (stop func()) {
+	m.loopsLock.Lock()
+	defer m.loopsLock.Unlock()
+	if m.closed != 0 {
+		return func() {}
+	}
+	stop = every(interval, tick)
+	m.loops = append(m.loops, stop)
+	return
+}
+
+// copy of every cached item that hasn't expired, nil for an uninitialized
+// cache. Nothing is fetched. Useful when comparing caches that should be
+// identical amongst servers, expired items that haven't been dropped yet
+// would only make them differ. Safe to call while the cache is being written
+// to, each shard is copied under its read lock, though writes landing during
+// the snapshot may or may not be in it
+func (m *Cache) Snapshot() map[string]interface{} {
+	return m.snapshot(false, nil)
+}
+
+// like Snapshot, but with the expired items that are still around, for
+// debugging
+func (m *Cache) SnapshotIncludingExpired() map[string]interface{} {
+	return m.snapshot(true, nil)
+}
+
+// like Snapshot, but only copies the items pred returns true for. pred is
+// called with the shard locked, so it must not use the cache
+func (m *Cache) SnapshotFunc(pred func(key string, value interface{}) bool) map[string]interface{} {
+	return m.snapshot(false, pred)
+}
+
+// snapshot copies the items pred returns true for, every item if pred is nil
+func (m *Cache) snapshot(includeExpired bool, pred func(key string, value interface{}) bool) map[string]interface{} {
+	if m.shards == nil {
+		return nil
+	}
+	now := m.now()
+	items := map[string]interface{}{}
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		for k, e := range s.items {
+			if (includeExpired || !e.expired(now)) && (pred == nil || pred(k, e.value)) {
+				items[k] = m.copyValue(e.value)
 			}
+		}
+		s.itemsLock.RUnlock()
+	}
+	return items
+}
 
-			m.itemsLock.Lock()
-			m.items[key] = value
-			m.itemsLock.Unlock()
-
-			m.isBeingFetchedLock.Lock()
-			m.isBeingFetchedMap[key] = false
-			m.isBeingFetchedLock.Unlock()
-		} else { // prevent thundering herd
-			m.isBeingFetchedWG[key].Wait()
-			m.itemsLock.RLock()
-			value = m.items[key]
-			m.itemsLock.RUnlock()
+// calls fn for every cached item that hasn't expired, stopping early when fn
+// returns false. Bounded caches go from the item that would be evicted first
+// to the one that would be evicted last, shard by shard, unbounded ones in no
+// particular order. Nothing is copied besides what WithValueCopier does, but
+// every shard is read locked while fn runs on its items so fn mustn't write
+// to the cache
+func (m *Cache) ForEach(fn func(key string, value interface{}) bool) {
+	if m.shards == nil {
+		return
+	}
+	now := m.now()
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		more := s.forEach(func(key string, e *entry) bool {
+			if e.expired(now) {
+				return true
+			}
+			return fn(key, m.copyValue(e.value))
+		})
+		s.itemsLock.RUnlock()
+		if !more {
+			return
 		}
 	}
-	return
 }
 
-// useful when comparing caches that should be identical amongst servers
-// TODO rename the function so it doesn't imply that fetches are involved
+// Deprecated: GetAll is an alias of Snapshot, the name wrongly implies that
+// fetches are involved
 func (m *Cache) GetAll() map[string]interface{} {
-	items := map[string]interface{}{}
-	m.itemsLock.RLock()
-	defer m.itemsLock.RUnlock()
-	if m.items == nil {
+	return m.Snapshot()
+}
+
+// reports whether key is cached and hasn't expired, without fetching it.
+// It doesn't count as a use for the lru or the stats. Fetches returning
+// (nil, nil) cache nil, which Has tells apart from a key that isn't cached,
+// see WithCacheNil to not cache them at all
+func (m *Cache) Has(key string) bool {
+	s := m.shardFor(key)
+	if s == nil {
+		return false
+	}
+	s.itemsLock.RLock()
+	defer s.itemsLock.RUnlock()
+	e, ok := s.items[key]
+	return ok && !e.expired(m.now())
+}
+
+// returns the cached value for key if there is one, never fetching or waiting
+// on a fetch. Like Has it only takes the read lock and doesn't count as a use
+// for the lru or the stats
+func (m *Cache) TryGet(key string) (value interface{}, ok bool) {
+	s := m.shardFor(key)
+	if s == nil {
+		return
+	}
+	s.itemsLock.RLock()
+	e, ok := s.items[key]
+	ok = ok && !e.expired(m.now())
+	if ok {
+		value = e.value
+	}
+	s.itemsLock.RUnlock()
+	value = m.copyValue(value)
+	return
+}
+
+// number of cached items, 0 for an uninitialized cache
+func (m *Cache) Len() (n int) {
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		n += len(s.items)
+		s.itemsLock.RUnlock()
+	}
+	return
+}
+
+// cached keys in no particular order, nil for an uninitialized cache
+func (m *Cache) Keys() []string {
+	if m.shards == nil {
 		return nil
 	}
-	for k, v := range m.items {
-		items[k] = v
+	keys := make([]string, 0, m.Len())
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		for k := range s.items {
+			keys = append(keys, k)
+		}
+		s.itemsLock.RUnlock()
 	}
-	return items
+	return keys
 }
 
+// empties every shard at once. Fetches in flight are forgotten, see Forget,
+// so they can't bring back what was just cleared. See WithPreviousGeneration
+// to keep serving the cleared items while the cache fills up again
 func (m *Cache) Clear() {
-	m.itemsLock.Lock()
-	m.items = make(map[string]interface{})
-	m.itemsLock.Unlock()
+	m.lockAll()
+	m.retainGeneration()
+	m.replace(nil)
+	m.unlockAll()
 	return
 }
 
+// removes key from the cache without fetching it again, and from the
+// backing store if there is one
+func (m *Cache) Delete(key string) (err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	if e, ok := s.items[key]; ok {
+		s.remove(key, e, ReasonManual)
+	}
+	s.unlock()
+	if m.store != nil {
+		err = m.store.Delete(key)
+	}
+	return
+}
+
+// removes every key in keys, returning how many of them were cached
+func (m *Cache) Invalidate(keys ...string) (removed int) {
+	for _, key := range keys {
+		s := m.shardFor(key)
+		if s == nil {
+			return
+		}
+		s.itemsLock.Lock()
+		if e, ok := s.items[key]; ok {
+			s.remove(key, e, ReasonManual)
+			removed++
+		}
+		s.unlock()
+	}
+	return
+}
+
+// removes every item pred returns true for, returning how many were removed.
+// pred is called with the shard locked, so it must not use the cache
+func (m *Cache) InvalidateFunc(pred func(key string, value interface{}) bool) (removed int) {
+	for _, s := range m.shards {
+		s.itemsLock.Lock()
+		for k, e := range s.items {
+			if pred(k, e.value) {
+				s.remove(k, e, ReasonManual)
+				removed++
+			}
+		}
+		s.unlock()
+	}
+	return
+}
+
+// forces a fetch of key even if it's already cached. If a fetch for key is
+// already in flight, Update shares it instead of starting another one, and
+// gets that miss while the update is running wait for it. See
+// WithUpdateDebounce to collapse bursts of updates into one fetch
 func (m *Cache) Update(key string) (err error) {
-	m.isBeingFetchedLock.RLock()
-	beingFetched := m.isBeingFetchedMap[key]
-	m.isBeingFetchedLock.RUnlock()
-
-	if beingFetched {
-		m.isBeingFetchedWG[key].Wait()
-	}
-	m.isBeingFetchedLock.Lock()
-	m.isBeingFetchedMap[key] = true
-	wg := m.isBeingFetchedWG[key]
-	if wg == nil {
-		wg = &sync.WaitGroup{}
-		m.isBeingFetchedWG[key] = wg
-	}
-	wg.Add(1)
-	m.isBeingFetchedLock.Unlock()
-	defer wg.Done()
-
-	// fetch value
-	value, err := m.fetch(key)
-	if err != nil {
+	_, err = m.update(key)
+	return
+}
+
+// like Update, but returns the fetched value
+func (m *Cache) Refresh(key string) (value interface{}, err error) {
+	e, err := m.update(key)
+	return m.copyValue(e.value), err
+}
+
+// inserts or overwrites the value for key without calling fetch. If a fetch
+// for key is in flight, value wins over its result and is what the waiting
+// gets receive
+func (m *Cache) Set(key string, value interface{}) (err error) {
+	if err = m.usable(); err != nil {
 		return
 	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	m.overrideFetch(key, s.store(key, value))
+	return
+}
 
-	m.itemsLock.Lock()
-	m.items[key] = value
-	m.itemsLock.Unlock()
+// returns the existing value for key if there is one, otherwise it stores and
+// returns value, just like sync.Map's LoadOrStore. loaded is true when the
+// value was already cached. fetch is never called
+func (m *Cache) GetOrSet(key string, value interface{}) (actual interface{}, loaded bool, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	if e, ok := s.items[key]; ok && !e.expired(m.now()) {
+		s.touch(e)
+		actual, loaded = m.copyValue(e.value), true
+		return
+	}
+	m.overrideFetch(key, s.store(key, value))
+	actual = value
+	return
+}
 
-	m.isBeingFetchedLock.Lock()
-	m.isBeingFetchedMap[key] = false
-	m.isBeingFetchedLock.Unlock()
+// stores new for key only if the value cached for key is still old, compared
+// with reflect.DeepEqual, so writers can update a key optimistically without
+// a lock of their own. swapped is false if key isn't cached, has expired or
+// holds something else. Like Set, new wins over a fetch in flight for key
+func (m *Cache) CompareAndSwap(key string, old, new interface{}) (swapped bool, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	e, ok := s.items[key]
+	if !ok || e.expired(m.now()) || !reflect.DeepEqual(e.value, old) {
+		return
+	}
+	m.overrideFetch(key, s.store(key, new))
+	swapped = true
 	return
 }
 
-/*
-func (m *Cache) PurgeAndInit() {
-	var items map[string]interface{}
-	var err error
-	if m.preWarmInit != nil {
-		items, err = (*m.preWarmInit)()
-		if err != nil {
-			common.LogErr(m.name+" preWarmInit", err)
-		}
+// clears the cache and fills it again with preWarmInit, or only clears it if
+// the cache wasn't created WithPreWarm. Either way the fetches in flight
+// when the items are swapped are forgotten like with Clear, so their results
+// aren't cached. If preWarmInit fails the current items are left alone and
+// its error is returned
+func (m *Cache) PurgeAndInit() (err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	if m.preWarmInit == nil {
+		m.Clear()
+		return
+	}
+	items, err := m.preWarmInit()
+	if err != nil {
+		return
 	}
-	if err != nil || m.preWarmInit == nil {
-		items = make(map[string]interface{})
+	m.lockAll()
+	m.retainGeneration()
+	m.replace(items)
+	m.unlockAll()
+	return
+}
+
+// swaps everything that's cached for items in one go, with all of the shards
+// locked so readers see either the old items or the new ones, never a mix.
+// Unlike SetMany, keys missing from items are dropped. Fetches in flight are
+// forgotten, like with Clear, and the items get the default ttl. Nothing is
+// kept for WithPreviousGeneration, items is meant to be complete
+func (m *Cache) ReplaceAll(items map[string]interface{}) (err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	m.lockAll()
+	m.replace(items)
+	m.unlockAll()
+	return
+}
+
+// replace drops every item and fetch in flight and stores items instead.
+// Must be called with every shard locked
+func (m *Cache) replace(items map[string]interface{}) {
+	for _, s := range m.shards {
+		s.reset(m.perShard(len(items)))
+	}
+	m.forgetAll()
+	atomic.AddUint64(&m.clears, 1)
+	m.publish(Event{Type: EventClear})
+	for k, v := range items {
+		m.shardFor(k).store(k, v)
 	}
-	m.itemsLock.Lock()
-	m.items = items
-	m.itemsLock.Unlock()
 }
-*/
@@ -1,19 +1,26 @@
 package tcache
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"math/rand"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
 	// create a simple cache without prewarming
-	cache, err := New(getMd5Value, nil)
+	cache, err := New(getMd5Value)
 	if err != nil {
 		t.Fatalf("error: %v, should not have returned an error", err)
 	}
@@ -26,7 +33,7 @@ func TestNew(t *testing.T) {
 	}
 
 	// test creating a prewarmed cache
-	cache, err = New(getMd5Value, &preWarm)
+	cache, err = New(getMd5Value, WithPreWarm(preWarm))
 	if err != nil {
 		t.Fatalf("error: %v, should not have returned an error", err)
 	}
@@ -44,14 +51,14 @@ func TestNew(t *testing.T) {
 		err = testErr
 		return
 	}
-	cache, err = New(getMd5Value, &preWarmErr)
+	cache, err = New(getMd5Value, WithPreWarm(preWarmErr))
 	if err != testErr {
-		t.Fatalf("error: %v, want %v", testErr)
+		t.Fatalf("error: %v, want %v", err, testErr)
 	}
 }
 
 func TestGet(t *testing.T) {
-	cache, _ := New(getMd5Value, nil)
+	cache, _ := New(getMd5Value)
 	valueInterface, err := cache.Get("2")
 	if err != nil {
 		t.Fatalf("error: %v, want nil", err)
@@ -66,7 +73,7 @@ func TestGet(t *testing.T) {
 	}
 
 	// create a prewarmed cache and start slamming it, run wit -race
-	cache, _ = New(getMd5Value, &preWarm)
+	cache, _ = New(getMd5Value, WithPreWarm(preWarm))
 	wg := &sync.WaitGroup{}
 	slam1To10ALot(cache, wg)
 	for k, vi := range preWarmMap {
@@ -95,7 +102,7 @@ func TestGet(t *testing.T) {
 
 func TestGetAll(t *testing.T) {
 	// create a simple md5 cache
-	cache, _ := New(getMd5Value, nil)
+	cache, _ := New(getMd5Value)
 
 	// make sure it returns an empty map
 	if cache.GetAll() == nil {
@@ -116,7 +123,7 @@ func TestGetAll(t *testing.T) {
 	}
 
 	// test a prewarmed cache
-	cache, _ = New(getMd5Value, &preWarm)
+	cache, _ = New(getMd5Value, WithPreWarm(preWarm))
 	eq = reflect.DeepEqual(
 		cache.GetAll(),
 		preWarmMap,
@@ -128,13 +135,467 @@ func TestGetAll(t *testing.T) {
 	// test getting a non initiated cache
 	cache = &Cache{}
 	if cache.GetAll() != nil {
-		t.Fatalf("values: %v, wanted nil")
+		t.Fatalf("values: %v, wanted nil", cache.GetAll())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	snapshot := cache.Snapshot()
+	if !reflect.DeepEqual(snapshot, preWarmMap) {
+		t.Fatalf("values: %v, want %v", snapshot, preWarmMap)
+	}
+
+	// the snapshot is a copy, changing it doesn't touch the cache
+	snapshot["1"] = "one"
+	delete(snapshot, "2")
+	if !reflect.DeepEqual(cache.Snapshot(), preWarmMap) {
+		t.Fatalf("values: %v, want %v", cache.Snapshot(), preWarmMap)
+	}
+	if !reflect.DeepEqual(cache.GetAll(), cache.Snapshot()) {
+		t.Fatal("GetAll and Snapshot should be equal")
+	}
+
+	// expired items are left out unless asked for
+	now := time.Now()
+	cache, _ = New(getMd5Value, WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+	cache.Set("fresh", "1")
+	cache.SetWithTTL("stale", "2", time.Second)
+	now = now.Add(2 * time.Second)
+	want := map[string]interface{}{"fresh": "1"}
+	if snapshot := cache.Snapshot(); !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("values: %v, want %v", snapshot, want)
+	}
+	want["stale"] = "2"
+	if snapshot := cache.SnapshotIncludingExpired(); !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("values: %v, want %v", snapshot, want)
+	}
+
+	cache = &Cache{}
+	if snapshot := cache.SnapshotIncludingExpired(); snapshot != nil {
+		t.Fatalf("values: %v, wanted nil", snapshot)
+	}
+	if snapshot := cache.Snapshot(); snapshot != nil {
+		t.Fatalf("values: %v, wanted nil", snapshot)
+	}
+}
+
+func TestSnapshotUnderLoad(t *testing.T) {
+	// run with -race, every kind of cache has to be safe to snapshot while
+	// it's being written to
+	caches := map[string][]Option{
+		"unbounded": nil,
+		"ttl":       {WithTTL(time.Millisecond), WithCleanupInterval(time.Millisecond)},
+		"lru":       {WithMaxEntries(5), WithShards(4)},
+		"lfu":       {WithMaxEntries(5), WithEvictionPolicy(PolicyLFU)},
+		"bytes":     {WithMaxBytes(200)},
+	}
+	for name, opts := range caches {
+		cache, _ := New(getMd5Value, opts...)
+		wg := &sync.WaitGroup{}
+		slam1To10ALot(cache, wg)
+		for i := 0; i < 1000; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key := strconv.Itoa(i%10 + 1)
+				switch i % 4 {
+				case 0:
+					cache.Set(key, computeMD5(key))
+				case 1:
+					cache.Delete(key)
+				case 2:
+					cache.SetWithTTL(key, computeMD5(key), time.Millisecond)
+				case 3:
+					cache.Update(key)
+				}
+			}(i)
+		}
+		for i := 0; i < 100; i++ {
+			for key, value := range cache.Snapshot() {
+				if !checkKey(key, value.(string)) {
+					t.Fatalf("%s: key %s, value %v, want %s", name, key, value, computeMD5(key))
+				}
+			}
+			cache.GetAll()
+			cache.Digest()
+		}
+		wg.Wait()
+		cache.Close()
+	}
+}
+
+func TestSnapshotFunc(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	for _, key := range []string{"user:1", "user:2", "group:1"} {
+		cache.Get(key)
+	}
+	snapshot := cache.SnapshotFunc(func(key string, value interface{}) bool {
+		return strings.HasPrefix(key, "user:")
+	})
+	want := map[string]interface{}{"user:1": computeMD5("user:1"), "user:2": computeMD5("user:2")}
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("values: %v, want %v", snapshot, want)
+	}
+
+	cache = &Cache{}
+	if snapshot := cache.SnapshotFunc(func(string, interface{}) bool { return true }); snapshot != nil {
+		t.Fatalf("values: %v, wanted nil", snapshot)
+	}
+}
+
+func TestHas(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm), WithTTL(time.Minute), WithStats())
+	if !cache.Has("1") {
+		t.Fatal("1 should be cached")
+	}
+	if cache.Has("11") {
+		t.Fatal("11 shouldn't be cached")
+	}
+	if stats := cache.Stats(); stats != (Stats{}) {
+		t.Fatalf("stats: %+v, Has shouldn't fetch or record anything", stats)
+	}
+
+	now := time.Now().Add(2 * time.Minute)
+	cache.now = func() time.Time { return now }
+	if cache.Has("1") {
+		t.Fatal("1 has expired")
+	}
+
+	cache = &Cache{}
+	if cache.Has("1") {
+		t.Fatal("an uninitialized cache has nothing")
+	}
+}
+
+func TestTryGet(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm), WithTTL(time.Minute), WithStats())
+	if value, ok := cache.TryGet("1"); !ok || !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, ok: %v, want 1 served from the cache", value, ok)
+	}
+	if value, ok := cache.TryGet("11"); ok || value != nil {
+		t.Fatalf("value: %v, ok: %v, want nothing", value, ok)
+	}
+	if cache.Has("11") {
+		t.Fatal("TryGet shouldn't fetch")
+	}
+	if stats := cache.Stats(); stats != (Stats{}) {
+		t.Fatalf("stats: %+v, TryGet shouldn't fetch or record anything", stats)
+	}
+
+	now := time.Now().Add(2 * time.Minute)
+	cache.now = func() time.Time { return now }
+	if _, ok := cache.TryGet("1"); ok {
+		t.Fatal("1 has expired")
+	}
+
+	cache = &Cache{}
+	if _, ok := cache.TryGet("1"); ok {
+		t.Fatal("an uninitialized cache has nothing")
+	}
+}
+
+func TestCacheNil(t *testing.T) {
+	var fetches int64
+	fetch := func(key string) (interface{}, error) {
+		atomic.AddInt64(&fetches, 1)
+		return nil, nil
+	}
+
+	// nil is cached by default, Has tells it apart from a missing key
+	cache, _ := New(fetch)
+	cache.Get("1")
+	if value, err := cache.Get("1"); value != nil || err != nil || fetches != 1 {
+		t.Fatalf("value: %v, error: %v, fetches: %d, want nil fetched once", value, err, fetches)
+	}
+	if !cache.Has("1") || cache.Has("2") {
+		t.Fatal("a cached nil is cached, a missing key isn't")
+	}
+
+	fetches = 0
+	cache, _ = New(fetch, WithCacheNil(false))
+	cache.Get("1")
+	cache.Get("1")
+	if fetches != 2 || cache.Has("1") {
+		t.Fatalf("fetches: %d, want 2 and nothing cached", fetches)
+	}
+	cache.Set("1", nil)
+	if !cache.Has("1") {
+		t.Fatal("Set still caches nil")
+	}
+}
+
+func TestSkipCache(t *testing.T) {
+	var fetches int64
+	cache, _ := New(func(key string) (interface{}, error) {
+		atomic.AddInt64(&fetches, 1)
+		return "placeholder", fmt.Errorf("upstream down: %w", ErrSkipCache)
+	}, WithRetry(3, 0), WithStats())
+	for i := 0; i < 2; i++ {
+		if value, err := cache.Get("1"); value != "placeholder" || err != nil {
+			t.Fatalf("value: %v, error: %v, want placeholder, nil", value, err)
+		}
+	}
+	if fetches != 2 || cache.Has("1") {
+		t.Fatalf("fetches: %d, want 2 and nothing cached", fetches)
+	}
+	if stats := cache.Stats(); stats.FetchErrors != 0 {
+		t.Fatalf("fetch errors: %d, want 0", stats.FetchErrors)
+	}
+
+	// an update keeps the cached value
+	cache.Set("1", "one")
+	if value, err := cache.Refresh("1"); value != "placeholder" || err != nil {
+		t.Fatalf("value: %v, error: %v, want placeholder, nil", value, err)
+	}
+	if value, _ := cache.TryGet("1"); value != "one" {
+		t.Fatalf("value: %v, want one", value)
+	}
+}
+
+func TestGetOrFetch(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	special := func(key string) (interface{}, error) {
+		return "special " + key, nil
+	}
+	if value, err := cache.GetOrFetch("1", special); err != nil || value != "special 1" {
+		t.Fatalf("value: %v, error: %v, want special 1", value, err)
+	}
+	if value, _ := cache.Get("1"); value != "special 1" {
+		t.Fatalf("value: %v, want the cached special 1", value)
+	}
+	cache.Get("3")
+	if value, _ := cache.GetOrFetch("3", special); !checkKey("3", value.(string)) {
+		t.Fatalf("value: %v, a hit doesn't fetch", value)
+	}
+}
+
+func TestSetFetch(t *testing.T) {
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		<-release
+		return "old " + key, nil
+	})
+	close(release)
+	cache.Get("1")
+
+	release = make(chan struct{})
+	got := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("2")
+		got <- value
+	}()
+	for _, ok := cache.calls.Load("2"); !ok; _, ok = cache.calls.Load("2") {
+		time.Sleep(time.Millisecond)
+	}
+	cache.SetFetch(func(key string) (interface{}, error) {
+		return "new " + key, nil
+	})
+	close(release)
+	if value := <-got; value != "old 2" {
+		t.Fatalf("value: %v, the running fetch finishes with the old fetch", value)
+	}
+	if value, _ := cache.Get("3"); value != "new 3" {
+		t.Fatalf("value: %v, want new 3", value)
+	}
+	if value, _ := cache.Get("1"); value != "old 1" {
+		t.Fatalf("value: %v, cached items are kept", value)
+	}
+
+	// it replaces a conditional fetch too
+	cache, _ = New(nil, WithConditionalFetch(func(key string, current interface{}) (interface{}, bool, error) {
+		return "conditional " + key, false, nil
+	}))
+	cache.SetFetch(func(key string) (interface{}, error) {
+		return "new " + key, nil
+	})
+	if value, _ := cache.Get("1"); value != "new 1" {
+		t.Fatalf("value: %v, want new 1", value)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cache, _ := New(getMd5Value, WithTTL(time.Minute))
+	cache.Set("1", []string{"a"})
+	if swapped, err := cache.CompareAndSwap("1", []string{"b"}, []string{"c"}); swapped || err != nil {
+		t.Fatalf("swapped: %v, error: %v, want no swap for another value", swapped, err)
+	}
+	if swapped, _ := cache.CompareAndSwap("1", []string{"a"}, []string{"c"}); !swapped {
+		t.Fatal("want a swap for an equal value")
+	}
+	if value, _ := cache.Get("1"); !reflect.DeepEqual(value, []string{"c"}) {
+		t.Fatalf("value: %v, want [c]", value)
+	}
+	if swapped, _ := cache.CompareAndSwap("2", nil, "two"); swapped || cache.Has("2") {
+		t.Fatal("a missing key is never swapped")
+	}
+
+	now := time.Now().Add(2 * time.Minute)
+	cache.now = func() time.Time { return now }
+	if swapped, _ := cache.CompareAndSwap("1", []string{"c"}, "d"); swapped {
+		t.Fatal("an expired key is never swapped")
+	}
+
+	// only one of the racing writers wins
+	cache, _ = New(getMd5Value)
+	cache.Set("n", 0)
+	var wins int64
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if swapped, _ := cache.CompareAndSwap("n", 0, 1); swapped {
+				atomic.AddInt64(&wins, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Fatalf("wins: %d, want 1", wins)
+	}
+
+	cache = &Cache{}
+	if _, err := cache.CompareAndSwap("1", nil, nil); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestName(t *testing.T) {
+	panicky := func(key string) (interface{}, error) {
+		panic("boom")
+	}
+	cache, _ := New(panicky)
+	if cache.Name() != "" {
+		t.Fatalf("name: %q, want empty by default", cache.Name())
+	}
+	if _, err := cache.Get("1"); err.Error() != "fetch panicked: boom" {
+		t.Fatalf("error: %v, want it without a name", err)
+	}
+
+	cache, _ = New(panicky, WithName("users"))
+	if cache.Name() != "users" {
+		t.Fatalf("name: %q, want users", cache.Name())
+	}
+	_, err := cache.Get("1")
+	if !errors.Is(err, ErrFetchPanicked) || !strings.Contains(err.Error(), `cache "users"`) {
+		t.Fatalf("error: %v, want a named ErrFetchPanicked", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	cache, _ := New(getMd5Value, WithTTL(time.Minute), WithCleanupInterval(time.Millisecond))
+	cache.Get("1")
+	stop := cache.StartRefresh(time.Millisecond)
+	if err := cache.Close(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("error: %v, closing twice is fine", err)
+	}
+	stop()
+
+	if _, err := cache.Get("1"); err != ErrClosed {
+		t.Fatalf("error: %v, want %v", err, ErrClosed)
+	}
+	if err := cache.Set("1", "one"); err != ErrClosed {
+		t.Fatalf("error: %v, want %v", err, ErrClosed)
+	}
+	if err := cache.Update("1"); err != ErrClosed {
+		t.Fatalf("error: %v, want %v", err, ErrClosed)
+	}
+	if !cache.Has("1") {
+		t.Fatal("what's cached can still be read after Close")
+	}
+	cache.StartRefresh(time.Millisecond)()
+
+	// named caches name the error
+	cache, _ = New(getMd5Value, WithName("users"))
+	cache.Close()
+	if _, err := cache.Get("1"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("error: %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestValueCopier(t *testing.T) {
+	fetch := func(key string) (interface{}, error) {
+		return []string{key}, nil
+	}
+
+	// without a copier everyone shares the same slice
+	cache, _ := New(fetch)
+	value, _ := cache.Get("1")
+	value.([]string)[0] = "changed"
+	if value, _ := cache.Get("1"); value.([]string)[0] != "changed" {
+		t.Fatalf("value: %v, want the shared slice", value)
+	}
+
+	cache, _ = New(fetch, WithValueCopier(func(v interface{}) interface{} {
+		return append([]string(nil), v.([]string)...)
+	}))
+	value, _ = cache.Get("1")
+	value.([]string)[0] = "changed"
+	if value, _ := cache.Get("1"); value.([]string)[0] != "1" {
+		t.Fatalf("value: %v, want [1]", value)
+	}
+	cache.Snapshot()["1"].([]string)[0] = "changed"
+	value, _, _ = cache.GetWithExpiry("1")
+	if value.([]string)[0] != "1" {
+		t.Fatalf("value: %v, want [1]", value)
+	}
+	actual, _, _ := cache.GetOrSet("1", nil)
+	actual.([]string)[0] = "changed"
+	values, _ := cache.GetMany([]string{"1"})
+	values["1"].([]string)[0] = "changed"
+	if value, _ := cache.Get("1"); value.([]string)[0] != "1" {
+		t.Fatalf("value: %v, want [1]", value)
+	}
+}
+
+func TestLen(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	if n := cache.Len(); n != len(preWarmMap) {
+		t.Fatalf("len: %d, want %d", n, len(preWarmMap))
+	}
+	cache.Get("11")
+	if n := cache.Len(); n != len(preWarmMap)+1 {
+		t.Fatalf("len: %d, want %d", n, len(preWarmMap)+1)
+	}
+
+	cache = &Cache{}
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("len: %d, want 0", n)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	keys := cache.Keys()
+	sort.Strings(keys)
+	want := make([]string, 0, len(preWarmMap))
+	for k := range preWarmMap {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("keys: %v, want %v", keys, want)
+	}
+
+	cache, _ = New(getMd5Value)
+	if keys := cache.Keys(); keys == nil || len(keys) != 0 {
+		t.Fatalf("keys: %v, want an empty slice", keys)
+	}
+
+	cache = &Cache{}
+	if keys := cache.Keys(); keys != nil {
+		t.Fatalf("keys: %v, want nil", keys)
 	}
 }
 
 func TestClear(t *testing.T) {
 	// test clearing an initialized cache
-	cache, _ := New(getMd5Value, &preWarm)
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
 	eq := reflect.DeepEqual(
 		cache.GetAll(),
 		preWarmMap,
@@ -151,9 +612,286 @@ func TestClear(t *testing.T) {
 	}
 }
 
-// TODO
+func TestClearDuringFetch(t *testing.T) {
+	release := make(chan struct{})
+	var calls int64
+	cache, _ := New(func(key string) (interface{}, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-release
+			return "stale", nil
+		}
+		return "fresh", nil
+	})
+	got := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("1")
+		got <- value
+	}()
+	for atomic.LoadInt64(&calls) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Clear()
+	close(release)
+
+	// the get that started before Clear still gets its value, but it doesn't
+	// repopulate the cache and nothing is left in flight
+	if value := <-got; value != "stale" {
+		t.Fatalf("value: %v, want stale", value)
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("values: %v, want nothing after Clear", cache.Snapshot())
+	}
+	inflight := 0
+	cache.calls.Range(func(key, c interface{}) bool {
+		inflight++
+		return true
+	})
+	if inflight != 0 {
+		t.Fatalf("fetches in flight: %d, want 0", inflight)
+	}
+	if value, _ := cache.Get("1"); value != "fresh" {
+		t.Fatalf("value: %v, want fresh", value)
+	}
+
+	// the same goes for gets fetching on their own
+	release = make(chan struct{})
+	started := make(chan struct{})
+	cache, _ = New(func(key string) (interface{}, error) {
+		close(started)
+		<-release
+		return "stale", nil
+	}, WithSingleFlight(false))
+	go func() {
+		value, _ := cache.Get("1")
+		got <- value
+	}()
+	<-started
+	cache.Clear()
+	close(release)
+	if value := <-got; value != "stale" {
+		t.Fatalf("value: %v, want stale", value)
+	}
+	if cache.Has("1") {
+		t.Fatalf("values: %v, want nothing after Clear", cache.Snapshot())
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	if removed := cache.Invalidate("1", "2", "11"); removed != 2 {
+		t.Fatalf("removed: %d, want 2", removed)
+	}
+	if cache.Has("1") || cache.Has("2") || cache.Len() != len(preWarmMap)-2 {
+		t.Fatalf("values: %v, want 1 and 2 removed", cache.Snapshot())
+	}
+	if removed := cache.Invalidate(); removed != 0 {
+		t.Fatalf("removed: %d, want 0", removed)
+	}
+
+	cache = &Cache{}
+	if removed := cache.Invalidate("1"); removed != 0 {
+		t.Fatalf("removed: %d, want 0", removed)
+	}
+}
+
+func TestInvalidateFunc(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	for _, key := range []string{"user:1", "user:2", "group:1"} {
+		cache.Get(key)
+	}
+	removed := cache.InvalidateFunc(func(key string, value interface{}) bool {
+		return strings.HasPrefix(key, "user:")
+	})
+	if removed != 2 {
+		t.Fatalf("removed: %d, want 2", removed)
+	}
+	if keys := cache.Keys(); len(keys) != 1 || keys[0] != "group:1" {
+		t.Fatalf("keys: %v, want [group:1]", keys)
+	}
+
+	// the value is passed along too
+	removed = cache.InvalidateFunc(func(key string, value interface{}) bool {
+		return value == computeMD5("group:1")
+	})
+	if removed != 1 || cache.Len() != 0 {
+		t.Fatalf("removed: %d, len: %d, want 1, 0", removed, cache.Len())
+	}
+}
+
+func TestPurgeAndInit(t *testing.T) {
+	var fail bool
+	testErr := errors.New("error")
+	cache, _ := New(getMd5Value, WithPreWarm(func() (map[string]interface{}, error) {
+		if fail {
+			return nil, testErr
+		}
+		return create1To10MD5Map(), nil
+	}))
+	cache.Get("11")
+	cache.Set("1", "one")
+	if err := cache.PurgeAndInit(); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if !reflect.DeepEqual(cache.Snapshot(), preWarmMap) {
+		t.Fatalf("values: %v, want %v", cache.Snapshot(), preWarmMap)
+	}
+
+	// a failing prewarm keeps what's already there
+	cache.Get("11")
+	want := cache.Snapshot()
+	fail = true
+	if err := cache.PurgeAndInit(); err != testErr {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+	if !reflect.DeepEqual(cache.Snapshot(), want) {
+		t.Fatalf("values: %v, want %v", cache.Snapshot(), want)
+	}
+
+	// without a prewarm it's just a Clear
+	cache, _ = New(getMd5Value)
+	cache.Get("1")
+	if err := cache.PurgeAndInit(); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("len: %d, want 0", n)
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		<-release
+		return "stale", nil
+	}, WithPreWarm(preWarm))
+	got := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("11")
+		got <- value
+	}()
+	for {
+		if _, ok := cache.calls.Load("11"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	items := map[string]interface{}{"1": "one", "11": "eleven"}
+	if err := cache.ReplaceAll(items); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	close(release)
+	// the fetch that was in flight is forgotten instead of overwriting 11
+	if value := <-got; value != "stale" {
+		t.Fatalf("value: %v, want stale", value)
+	}
+	if !reflect.DeepEqual(cache.Snapshot(), items) {
+		t.Fatalf("values: %v, want %v", cache.Snapshot(), items)
+	}
+
+	cache.Close()
+	if err := cache.ReplaceAll(items); !errors.Is(err, ErrClosed) {
+		t.Fatalf("error: %v, want %v", err, ErrClosed)
+	}
+}
+
 func TestUpdate(t *testing.T) {
+	// every fetch returns the number of fetches so far
+	var calls int64
+	cache, _ := New(func(key string) (interface{}, error) {
+		return atomic.AddInt64(&calls, 1), nil
+	})
+	cache.Get("1")
+	if err := cache.Update("1"); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if value, _ := cache.Get("1"); value.(int64) != 2 {
+		t.Fatalf("value: %v, want 2", value)
+	}
+
+	// an update failing leaves the old value alone
+	testErr := errors.New("error")
+	cache, _ = New(getMd5Value, WithPreWarm(preWarm))
+	cache.SetFetch(func(key string) (interface{}, error) {
+		return nil, testErr
+	})
+	if err := cache.Update("1"); !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+	if value, _ := cache.Get("1"); value != preWarmMap["1"] {
+		t.Fatalf("value: %v, want %v", value, preWarmMap["1"])
+	}
+}
+
+func TestUpdateSingleFlight(t *testing.T) {
+	var calls, running int64
+	overlapped := false
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		n := atomic.AddInt64(&calls, 1)
+		if atomic.AddInt64(&running, 1) > 1 {
+			overlapped = true
+		}
+		<-release
+		atomic.AddInt64(&running, -1)
+		return n, nil
+	}, WithStats())
+	waitFor := func(cond func() bool) {
+		for !cond() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// gets that miss while an update is fetching wait for its value
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		cache.Update("1")
+		wg.Done()
+	}()
+	waitFor(func() bool { return atomic.LoadInt64(&calls) == 1 })
+	values := make(chan interface{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			value, _ := cache.Get("1")
+			values <- value
+			wg.Done()
+		}()
+	}
+	waitFor(func() bool { return cache.Stats().HerdWaits == 10 })
+	release <- struct{}{}
+	wg.Wait()
+	close(values)
+	for value := range values {
+		if value.(int64) != 1 {
+			t.Fatalf("value: %v, want 1", value)
+		}
+	}
 
+	// an update racing an organic miss shares its fetch
+	wg.Add(2)
+	go func() {
+		cache.Get("2")
+		wg.Done()
+	}()
+	waitFor(func() bool { return atomic.LoadInt64(&calls) == 2 })
+	go func() {
+		cache.Update("2")
+		wg.Done()
+	}()
+	waitFor(func() bool { return cache.Stats().HerdWaits == 11 })
+	release <- struct{}{}
+	wg.Wait()
+	if overlapped {
+		t.Fatal("fetches for the same key should never run at the same time")
+	}
+	if calls != 2 {
+		t.Fatalf("calls: %d, want a single fetch for the get and the update", calls)
+	}
+	if value, _ := cache.Get("2"); value.(int64) != 2 {
+		t.Fatalf("value: %v, want 2", value)
+	}
 }
 
 func create1To10MD5Map() map[string]interface{} {
@@ -207,3 +945,382 @@ func slam1To10ALot(cache *Cache, wg *sync.WaitGroup) {
 		}(cache, wg)
 	}
 }
+
+// slamMixed1To10ALot is slam1To10ALot with updates, refreshes, deletes and
+// sets of the same keys thrown in, failing t if anything errors or a get or
+// refresh returns a value that isn't the md5 of its key
+func slamMixed1To10ALot(t *testing.T, cache *Cache, wg *sync.WaitGroup) {
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				key := strconv.Itoa(rand.Intn(9) + 1)
+				var value interface{}
+				var err error
+				switch rand.Intn(5) {
+				case 0:
+					err = cache.Update(key)
+				case 1:
+					value, err = cache.Refresh(key)
+				case 2:
+					err = cache.Delete(key)
+				case 3:
+					err = cache.Set(key, computeMD5(key))
+				default:
+					value, err = cache.Get(key)
+				}
+				if err != nil {
+					t.Errorf("key %s: error %v, want nil", key, err)
+				} else if value != nil && !checkKey(key, value.(string)) {
+					t.Errorf("key %s: value %v isn't its md5", key, value)
+				}
+			}
+		}()
+	}
+}
+
+func TestMixedMutations(t *testing.T) {
+	// run with -race
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	wg := &sync.WaitGroup{}
+	slamMixed1To10ALot(t, cache, wg)
+	wg.Wait()
+	for k := range preWarmMap {
+		value, err := cache.Get(k)
+		if err != nil || !checkKey(k, value.(string)) {
+			t.Fatalf("key %s: value %v, error %v, want its md5", k, value, err)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		n := atomic.AddInt64(&calls, 1)
+		<-release
+		return n, nil
+	}, WithStats())
+	close(release)
+	cache.Get("1")
+	value, err := cache.Refresh("1")
+	if err != nil || value.(int64) != 2 {
+		t.Fatalf("value: %v, error: %v, want 2, nil", value, err)
+	}
+	if value, _ := cache.Get("1"); value.(int64) != 2 {
+		t.Fatalf("value: %v, want 2", value)
+	}
+
+	// a refresh racing a get shares its fetch
+	release = make(chan struct{})
+	got := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("2")
+		got <- value
+	}()
+	for atomic.LoadInt64(&calls) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	refreshed := make(chan interface{})
+	go func() {
+		value, _ := cache.Refresh("2")
+		refreshed <- value
+	}()
+	for cache.Stats().HerdWaits != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if a, b := <-got, <-refreshed; a.(int64) != 3 || b.(int64) != 3 {
+		t.Fatalf("values: %v and %v, want 3 for both", a, b)
+	}
+	if calls != 3 {
+		t.Fatalf("calls: %d, want 3", calls)
+	}
+
+	cache = &Cache{}
+	if _, err := cache.Refresh("1"); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestSet(t *testing.T) {
+	cache, _ := New(getMd5Value, WithStats())
+	if err := cache.Set("1", "one"); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if value, _ := cache.Get("1"); value != "one" {
+		t.Fatalf("value: %v, want one", value)
+	}
+	if stats := cache.Stats(); stats.Fetches != 0 {
+		t.Fatalf("fetches: %d, want 0", stats.Fetches)
+	}
+
+	// a Set during a fetch wins over the fetched value
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache, _ = New(func(key string) (interface{}, error) {
+		close(started)
+		<-release
+		return computeMD5(key), nil
+	}, WithStats())
+	leader := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("2")
+		leader <- value
+	}()
+	<-started
+	waiter := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("2")
+		waiter <- value
+	}()
+	for cache.Stats().HerdWaits != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Set("2", "two")
+	close(release)
+	if value := <-leader; value != "two" {
+		t.Fatalf("leader value: %v, want two", value)
+	}
+	if value := <-waiter; value != "two" {
+		t.Fatalf("waiter value: %v, want two", value)
+	}
+	if value := cache.GetAll()["2"]; value != "two" {
+		t.Fatalf("value: %v, want two", value)
+	}
+
+	// setting an uninitialized cache
+	cache = &Cache{}
+	if err := cache.Set("1", "one"); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm), WithStats())
+
+	// an existing value is returned and left alone
+	actual, loaded, err := cache.GetOrSet("1", "one")
+	if err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if !loaded || actual != preWarmMap["1"] {
+		t.Fatalf("actual: %v, loaded: %v, want %v, true", actual, loaded, preWarmMap["1"])
+	}
+
+	// a missing value is stored without fetching
+	actual, loaded, _ = cache.GetOrSet("11", "eleven")
+	if loaded || actual != "eleven" {
+		t.Fatalf("actual: %v, loaded: %v, want eleven, false", actual, loaded)
+	}
+	if value, _ := cache.Get("11"); value != "eleven" {
+		t.Fatalf("value: %v, want eleven", value)
+	}
+	if stats := cache.Stats(); stats.Fetches != 0 {
+		t.Fatalf("fetches: %d, want 0", stats.Fetches)
+	}
+
+	// only one of many racing goroutines gets to store its value
+	var stored int64
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			if _, loaded, _ := cache.GetOrSet("12", i); !loaded {
+				atomic.AddInt64(&stored, 1)
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	if stored != 1 {
+		t.Fatalf("stored: %d, want 1", stored)
+	}
+
+	cache = &Cache{}
+	if _, _, err := cache.GetOrSet("1", "one"); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+// every Get misses on a distinct key, so the cost is dominated by the fetch
+// coordination rather than the lookup
+func BenchmarkGetMissesSingleFlight(b *testing.B) {
+	benchmarkGetMisses(b, true)
+}
+
+func BenchmarkGetMissesNoSingleFlight(b *testing.B) {
+	benchmarkGetMisses(b, false)
+}
+
+// benchmarkGetMisses gets the same few keys over and over with a trivial
+// fetch whose result is never cached, so every get misses
+func benchmarkGetMisses(b *testing.B, singleFlight bool) {
+	cache, _ := New(func(key string) (interface{}, error) {
+		return nil, nil
+	}, WithCacheNil(false), WithSingleFlight(singleFlight))
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.Get(strconv.FormatInt(atomic.AddInt64(&n, 1)%10, 10))
+		}
+	})
+}
+
+// BenchmarkGetHotKeyHerd has a herd of gets miss on the same key at once,
+// holding the fetch back until all but one of them wait on it, so it measures
+// how the waiters are parked and woken up rather than the fetch
+func BenchmarkGetHotKeyHerd(b *testing.B) {
+	const herd = 100
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		<-release
+		return key, nil
+	}, WithStats())
+	var wg sync.WaitGroup
+	for i := 0; i < b.N; i++ {
+		key := strconv.Itoa(i)
+		waits := cache.Stats().HerdWaits + herd - 1
+		wg.Add(herd)
+		for j := 0; j < herd; j++ {
+			go func() {
+				defer wg.Done()
+				cache.Get(key)
+			}()
+		}
+		for cache.Stats().HerdWaits != waits {
+			runtime.Gosched()
+		}
+		release <- struct{}{}
+		wg.Wait()
+	}
+}
+
+// BenchmarkGetDistinctKeys has every get miss on a key of its own, so it
+// measures the cost of claiming and releasing keys. Run it with -cpu to see
+// how that scales, a single core has no parallelism for it to show
+func BenchmarkGetDistinctKeys(b *testing.B) {
+	cache, _ := New(func(key string) (interface{}, error) {
+		return key, nil
+	})
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cache.Get(strconv.FormatInt(atomic.AddInt64(&n, 1), 10))
+		}
+	})
+}
+
+// BenchmarkGetHits gets keys that are all cached, with the options that make
+// a hit do more than a map lookup
+func BenchmarkGetHits(b *testing.B) {
+	for name, opts := range map[string][]Option{
+		"unbounded": nil,
+		"ttl":       {WithTTL(time.Hour), WithSoftTTL(time.Hour)},
+		"lru":       {WithMaxEntries(100)},
+		"fifo":      {WithMaxEntries(100), WithEvictionPolicy(PolicyFIFO)},
+		"store":     {WithBackingStore(NewMemoryStore())},
+		"transform": {WithTransform(func(key string, value interface{}) (interface{}, error) { return value, nil })},
+	} {
+		b.Run(name, func(b *testing.B) {
+			cache, _ := New(getMd5Value, opts...)
+			keys := make([]string, 10)
+			for i := range keys {
+				keys[i] = strconv.Itoa(i)
+				cache.Get(keys[i])
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					cache.Get(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestZeroValueCache(t *testing.T) {
+	cache := &Cache{}
+	fetch := func(key string) (interface{}, error) {
+		return key, nil
+	}
+	if cache.Initialized() {
+		t.Fatal("initialized: true, want false")
+	}
+	if initialized, _ := New(fetch); !initialized.Initialized() {
+		t.Fatal("initialized: false, want true for a cache created by New")
+	}
+	// every method reporting errors reports ErrNotInitialized, instead of
+	// panicking
+	calls := map[string]func() error{
+		"Get":             func() error { _, err := cache.Get("1"); return err },
+		"GetContext":      func() error { _, err := cache.GetContext(context.Background(), "1"); return err },
+		"GetOrFetch":      func() error { _, err := cache.GetOrFetch("1", fetch); return err },
+		"GetKey":          func() error { _, err := cache.GetKey("1"); return err },
+		"GetWithArg":      func() error { _, err := cache.GetWithArg("1", nil); return err },
+		"GetWithSource":   func() error { _, _, err := cache.GetWithSource("1"); return err },
+		"GetWithExpiry":   func() error { _, _, err := cache.GetWithExpiry("1"); return err },
+		"GetWithMeta":     func() error { _, _, err := cache.GetWithMeta("1"); return err },
+		"GetString":       func() error { _, err := cache.GetString("1"); return err },
+		"GetMany":         func() error { _, err := cache.GetMany([]string{"1"}); return err },
+		"SetMany":         func() error { return cache.SetMany(map[string]interface{}{"1": 1}) },
+		"Set":             func() error { return cache.Set("1", 1) },
+		"SetWithTTL":      func() error { return cache.SetWithTTL("1", 1, time.Second) },
+		"SetWithMeta":     func() error { return cache.SetWithMeta("1", 1, nil) },
+		"GetOrSet":        func() error { _, _, err := cache.GetOrSet("1", 1); return err },
+		"CompareAndSwap":  func() error { _, err := cache.CompareAndSwap("1", 1, 2); return err },
+		"GetWithGen":      func() error { _, _, err := cache.GetWithGen("1"); return err },
+		"GetFresherThan":  func() error { _, err := cache.GetFresherThan("1", time.Second); return err },
+		"GetWithFallback": func() error { _, _, err := cache.GetWithFallback("1"); return err },
+		"SetIfGen":        func() error { _, err := cache.SetIfGen("1", 1, 1); return err },
+		"Update":          func() error { return cache.Update("1") },
+		"Refresh":         func() error { _, err := cache.Refresh("1"); return err },
+		"Delete":          func() error { return cache.Delete("1") },
+		"PurgeAndInit":    func() error { return cache.PurgeAndInit() },
+		"ReplaceAll":      func() error { return cache.ReplaceAll(map[string]interface{}{"1": 1}) },
+		"Save":            func() error { return cache.Save(&strings.Builder{}) },
+		"UnmarshalJSON":   func() error { return cache.UnmarshalJSON([]byte(`{"1":1}`)) },
+	}
+	for name, call := range calls {
+		if err := call(); err != ErrNotInitialized {
+			t.Errorf("%s: error: %v, want %v", name, err, ErrNotInitialized)
+		}
+	}
+
+	// and the rest don't panic
+	cache.Invalidate("1")
+	cache.InvalidateFunc(func(string, interface{}) bool { return true })
+	cache.Clear()
+	cache.Forget("1")
+	cache.Resize(1)
+	cache.Touch("1")
+	cache.ForEach(func(string, interface{}) bool { return true })
+	cache.SnapshotFunc(func(string, interface{}) bool { return true })
+	cache.View()
+	cache.Digest()
+	cache.Stats()
+	cache.ResetStats()
+	cache.SetFetch(fetch)
+	cache.OnEvict(func(string, interface{}) {})
+	cache.StartRefresh(time.Millisecond)()
+	cache.Close()
+}
+
+func TestFetchError(t *testing.T) {
+	testErr := errors.New("error")
+	cache, _ := New(func(key string) (interface{}, error) {
+		return nil, testErr
+	})
+	_, err := cache.Get("1")
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Key != "1" || !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want a FetchError for 1 wrapping %v", err, testErr)
+	}
+	if msg := err.Error(); msg != "fetching 1: error" {
+		t.Fatalf("message: %q, want %q", msg, "fetching 1: error")
+	}
+}
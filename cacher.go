@@ -0,0 +1,13 @@
+package tcache
+
+// Cacher is the handful of methods generic caching code usually abstracts
+// over, so a Cache can be dropped in wherever such an interface is expected.
+// Get fetches on a miss like Cache.Get does
+type Cacher interface {
+	Get(key string) (value interface{}, err error)
+	Set(key string, value interface{}) error
+	Delete(key string) error
+	Clear()
+}
+
+var _ Cacher = (*Cache)(nil)
@@ -0,0 +1,46 @@
+package tcache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// stable hash of every cached item, two caches holding the same items have
+// the same digest no matter in which order they were stored. Strings and byte
+// slices are hashed as is, any other value through its %#v formatting, so
+// values holding pointers only digest the same within a single process
+func (m *Cache) Digest() string {
+	items := m.Snapshot()
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		writeField(h, []byte(k))
+		switch v := items[k].(type) {
+		case string:
+			writeField(h, []byte(v))
+		case []byte:
+			writeField(h, v)
+		default:
+			writeField(h, []byte(fmt.Sprintf("%T %#v", v, v)))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeField length prefixes b so that adjacent fields can't run into each
+// other, e.g. "ab"+"c" and "a"+"bc"
+func writeField(h hash.Hash, b []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+	h.Write(size[:])
+	h.Write(b)
+}
@@ -0,0 +1,53 @@
+package tcache
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	a, _ := New(getMd5Value, WithPreWarm(preWarm))
+	b, _ := New(getMd5Value)
+	for i := 10; i >= 1; i-- {
+		b.Get(strconv.Itoa(i))
+	}
+	if a.Digest() != b.Digest() {
+		t.Fatal("caches with the same items should have the same digest")
+	}
+
+	// any difference changes the digest
+	b.Set("1", "one")
+	if a.Digest() == b.Digest() {
+		t.Fatal("caches with different values should have different digests")
+	}
+	b.Set("1", computeMD5("1"))
+	b.Set("11", computeMD5("11"))
+	if a.Digest() == b.Digest() {
+		t.Fatal("caches with different keys should have different digests")
+	}
+
+	// fields can't bleed into each other
+	a, _ = New(getMd5Value)
+	b, _ = New(getMd5Value)
+	a.Set("ab", "c")
+	b.Set("a", "bc")
+	if a.Digest() == b.Digest() {
+		t.Fatal("different items should have different digests")
+	}
+
+	// values that aren't strings
+	a, _ = New(getMd5Value)
+	b, _ = New(getMd5Value)
+	a.Set("1", map[string]int{"a": 1, "b": 2})
+	b.Set("1", map[string]int{"b": 2, "a": 1})
+	a.Set("2", []byte("two"))
+	b.Set("2", []byte("two"))
+	if a.Digest() != b.Digest() {
+		t.Fatal("equal values should have the same digest")
+	}
+	a.Set("3", 3)
+	b.Set("3", "3")
+	if a.Digest() == b.Digest() {
+		t.Fatal("values of different types should have different digests")
+	}
+}
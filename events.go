@@ -0,0 +1,142 @@
+package tcache
+
+// event is something that happened to an entry while itemsLock was held. It's
+// published to the subscriptions right away and its callbacks run once the
+// lock is released
+type event struct {
+	key     string
+	value   interface{}
+	meta    map[string]string
+	evicted bool
+	reason  EvictReason // why it was evicted
+	cleared bool        // evicted by Clear and friends, which publish a single EventClear
+}
+
+// EvictReason is why an entry left the cache, see WithEvictionObserver
+type EvictReason int
+
+const (
+	// ReasonCapacity is an entry evicted to make room under WithMaxEntries
+	// or WithMaxBytes
+	ReasonCapacity EvictReason = iota
+	// ReasonTTL is an entry that expired
+	ReasonTTL
+	// ReasonManual is an entry removed by Delete, Invalidate, Clear and the
+	// like
+	ReasonManual
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonTTL:
+		return "ttl"
+	case ReasonManual:
+		return "manual"
+	}
+	return "unknown"
+}
+
+// registers fn to be called whenever an entry leaves the cache, whether it
+// was deleted, cleared, evicted by the lru or expired. Callbacks run after
+// the cache's locks are released, so they're free to use the cache
+func (m *Cache) OnEvict(fn func(key string, value interface{})) {
+	m.OnEvictWithMeta(func(key string, value interface{}, meta map[string]string) {
+		fn(key, value)
+	})
+}
+
+// like OnEvict, but fn also gets the metadata the entry was stored with by
+// SetWithMeta, nil if there was none
+func (m *Cache) OnEvictWithMeta(fn func(key string, value interface{}, meta map[string]string)) {
+	m.callbacksLock.Lock()
+	m.onEvict = append(m.onEvict, fn)
+	m.callbacksLock.Unlock()
+}
+
+// registers fn to be called whenever a value is stored, either fetched or
+// Set. Like OnEvict it runs outside of the cache's locks
+func (m *Cache) OnSet(fn func(key string, value interface{})) {
+	m.callbacksLock.Lock()
+	m.onSet = append(m.onSet, func(key string, value interface{}, meta map[string]string) {
+		fn(key, value)
+	})
+	m.callbacksLock.Unlock()
+}
+
+// evicted records that key and its entry left the cache for reason. Must be
+// called with the shard's itemsLock held for writing
+func (s *shard) evicted(key string, e *entry, reason EvictReason) {
+	s.record(event{key: key, value: e.value, meta: e.meta, evicted: true, reason: reason})
+}
+
+// stored records that value was stored for key. Must be called with the
+// shard's itemsLock held for writing
+func (s *shard) stored(key string, value interface{}) {
+	s.record(event{key: key, value: value})
+}
+
+// record publishes ev while the shard is still locked, so subscribers get
+// the events of a key in the order they happened, and keeps it for unlock if
+// there are callbacks for it. Must be called with the shard's itemsLock held
+// for writing
+func (s *shard) record(ev event) {
+	m := s.cache
+	m.callbacksLock.RLock()
+	listening := len(m.onSet) > 0
+	if ev.evicted {
+		listening = len(m.onEvict) > 0 || m.evictObserver != nil
+	}
+	m.callbacksLock.RUnlock()
+	m.publishEvent(ev)
+	if listening {
+		s.pending = append(s.pending, ev)
+	}
+}
+
+// unlock releases the shard's itemsLock and then runs the callbacks for the
+// events recorded while it was held
+func (s *shard) unlock() {
+	events := s.pending
+	s.pending = nil
+	s.itemsLock.Unlock()
+	s.cache.runCallbacks(events)
+}
+
+// runCallbacks runs the callbacks for events. Must be called without any of
+// the shards locked
+func (m *Cache) runCallbacks(events []event) {
+	if len(events) == 0 {
+		return
+	}
+	m.callbacksLock.RLock()
+	onEvict, onSet := m.onEvict, m.onSet
+	m.callbacksLock.RUnlock()
+	for _, ev := range events {
+		callbacks := onSet
+		if ev.evicted {
+			callbacks = onEvict
+			if m.evictObserver != nil {
+				m.evictObserver(ev.key, ev.value, ev.reason)
+			}
+		}
+		for _, fn := range callbacks {
+			fn(ev.key, ev.value, ev.meta)
+		}
+	}
+}
+
+// publishEvent hands ev to the subscriptions as an Event
+func (m *Cache) publishEvent(ev event) {
+	switch {
+	case ev.cleared:
+		return
+	case !ev.evicted:
+		m.publish(Event{Type: EventSet, Key: ev.key, Value: ev.value})
+	case ev.reason == ReasonManual:
+		m.publish(Event{Type: EventDelete, Key: ev.key, Value: ev.value})
+	default:
+		m.publish(Event{Type: EventEvict, Key: ev.key, Value: ev.value})
+	}
+}
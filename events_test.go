@@ -0,0 +1,230 @@
+package tcache
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recorder collects the keys callbacks are called with
+type recorder struct {
+	lock sync.Mutex
+	keys []string
+}
+
+func (r *recorder) record(key string, value interface{}) {
+	r.lock.Lock()
+	r.keys = append(r.keys, key)
+	r.lock.Unlock()
+}
+
+// take returns the sorted keys recorded so far and forgets them
+func (r *recorder) take() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	keys := r.keys
+	r.keys = nil
+	sort.Strings(keys)
+	return keys
+}
+
+func TestOnEvict(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithMaxEntries(3), WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+	evicted := &recorder{}
+	cache.OnEvict(evicted.record)
+	check := func(want ...string) {
+		t.Helper()
+		if keys := evicted.take(); !reflect.DeepEqual(keys, want) {
+			t.Fatalf("evicted: %v, want %v", keys, want)
+		}
+	}
+
+	cache.Get("1")
+	cache.Get("2")
+	cache.Delete("2")
+	check("2")
+
+	// lru eviction
+	cache.Get("2")
+	cache.Get("3")
+	cache.Get("4")
+	check("1")
+
+	// expiry
+	now = now.Add(2 * time.Minute)
+	cache.Get("4")
+	check("4")
+
+	cache.Clear()
+	check("2", "3", "4")
+	cache.Delete("missing")
+	check()
+}
+
+func TestOnSet(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	set := &recorder{}
+	cache.OnSet(set.record)
+	cache.Get("1")
+	cache.Get("1")
+	cache.Set("2", "two")
+	cache.GetOrSet("2", "two")
+	cache.GetOrSet("3", "three")
+	cache.Update("4")
+	if keys := set.take(); !reflect.DeepEqual(keys, []string{"1", "2", "3", "4"}) {
+		t.Fatalf("set: %v, want [1 2 3 4]", keys)
+	}
+}
+
+func TestCallbacksReenter(t *testing.T) {
+	// callbacks run outside of the locks so using the cache from one
+	// doesn't deadlock
+	cache, _ := New(getMd5Value, WithMaxEntries(1))
+	cache.OnEvict(func(key string, value interface{}) {
+		cache.Has(key)
+		cache.Set("evicted", key)
+	})
+	cache.OnSet(func(key string, value interface{}) {
+		cache.Len()
+	})
+	cache.Get("1")
+	cache.Get("2")
+	if value, _ := cache.Get("evicted"); value != "2" {
+		t.Fatalf("value: %v, want 2", value)
+	}
+}
+
+func TestCallbacksReenterClear(t *testing.T) {
+	// Clear and friends lock every shard, the callbacks only run once all of
+	// them are unlocked
+	cache, _ := New(getMd5Value)
+	for i := 0; i < 100; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	var gets int64
+	cache.OnEvict(func(key string, value interface{}) {
+		cache.Get("57")
+		atomic.AddInt64(&gets, 1)
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.Clear()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlocked")
+	}
+	if gets != 100 {
+		t.Fatalf("gets: %d, want one per cleared item", gets)
+	}
+}
+
+func TestEvictionObserver(t *testing.T) {
+	now := time.Now()
+	var reasons []string
+	cache, _ := New(getMd5Value, WithMaxEntries(2), WithTTL(time.Minute),
+		WithEvictionObserver(func(key string, value interface{}, reason EvictReason) {
+			reasons = append(reasons, key+" "+reason.String())
+		}))
+	cache.now = func() time.Time { return now }
+
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("3")
+	cache.Delete("2")
+	// expired entries are evicted whether they're replaced or swept
+	now = now.Add(2 * time.Minute)
+	cache.Get("3")
+	now = now.Add(2 * time.Minute)
+	cache.shardFor("3").removeExpired(now)
+	cache.Set("4", "four")
+	cache.Clear()
+	want := []string{"1 capacity", "2 manual", "3 ttl", "3 ttl", "4 manual"}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Fatalf("evictions: %v, want %v", reasons, want)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cache, _ := New(getMd5Value, WithMaxEntries(2), WithStats())
+	events, unsubscribe := cache.Subscribe(10)
+	cache.Set("1", "one")
+	cache.Get("2")
+	cache.Get("3")
+	cache.Delete("2")
+	cache.ReplaceAll(map[string]interface{}{"4": "four"})
+	want := []Event{
+		{EventSet, "1", "one"},
+		{EventSet, "2", computeMD5("2")},
+		{EventSet, "3", computeMD5("3")},
+		{EventEvict, "1", "one"},
+		{EventDelete, "2", computeMD5("2")},
+		{EventClear, "", nil},
+		{EventSet, "4", "four"},
+	}
+	for _, w := range want {
+		if ev := <-events; ev != w {
+			t.Fatalf("event: %+v, want %+v", ev, w)
+		}
+	}
+
+	// a full buffer drops events instead of blocking
+	for i := 0; i < 11; i++ {
+		cache.Set("5", i)
+	}
+	if dropped := cache.Stats().EventsDropped; dropped != 1 {
+		t.Fatalf("dropped: %d, want 1", dropped)
+	}
+	unsubscribe()
+	unsubscribe()
+	n := 0
+	for range events {
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("events: %d, want the 10 buffered ones before the channel closes", n)
+	}
+	cache.Set("6", 6)
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	now := time.Now()
+	var cache *Cache
+	cache, _ = New(getMd5Value, WithTTL(time.Minute), WithEvictionObserver(func(key string, value interface{}, reason EvictReason) {
+		if reason == ReasonTTL {
+			cache.Clear()
+		}
+	}))
+	cache.now = func() time.Time { return now }
+	events, unsubscribe := cache.Subscribe(10)
+	cache.Set("1", "one")
+	now = now.Add(2 * time.Minute)
+	// overwriting the expired value evicts it and the observer clears the
+	// cache once the shard is unlocked, so the new value is gone too
+	cache.Set("1", "uno")
+	unsubscribe()
+
+	// replaying the events ends up with what's cached
+	replayed := map[string]interface{}{}
+	for ev := range events {
+		switch ev.Type {
+		case EventSet:
+			replayed[ev.Key] = ev.Value
+		case EventDelete, EventEvict:
+			delete(replayed, ev.Key)
+		case EventClear:
+			replayed = map[string]interface{}{}
+		}
+	}
+	if snapshot := cache.Snapshot(); !reflect.DeepEqual(replayed, snapshot) {
+		t.Fatalf("replayed: %v, want %v", replayed, snapshot)
+	}
+}
@@ -0,0 +1,26 @@
+package tcache_test
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	tcache "github.com/scrivy/thundering-cache"
+)
+
+func ExampleMemoize() {
+	slowSquare := func(key string) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		n, err := strconv.Atoi(key)
+		return n * n, err
+	}
+	_, square := tcache.Memoize(slowSquare)
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		square("12")
+	}
+	value, _ := square("12")
+	fmt.Println(value, time.Since(start) < 100*time.Millisecond)
+	// Output: 144 true
+}
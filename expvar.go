@@ -0,0 +1,34 @@
+package tcache
+
+import (
+	"expvar"
+	"sync"
+)
+
+// publishLock makes checking for and publishing an expvar a single step
+var publishLock sync.Mutex
+
+// expvarStats is what PublishExpvar shows for a cache
+type expvarStats struct {
+	Stats
+	Len int
+}
+
+// publishes the cache's Stats and Len as JSON under name on /debug/vars.
+// Returns ErrPublished if name is already taken, by this cache or anything
+// else, instead of panicking like expvar.Publish. expvar has no way to
+// unpublish, so the name stays taken and the cache reachable for as long as
+// the program runs. The cache has to be created with WithStats, otherwise
+// every counter stays at zero and only Len changes
+func (m *Cache) PublishExpvar(name string) (err error) {
+	publishLock.Lock()
+	defer publishLock.Unlock()
+	if expvar.Get(name) != nil {
+		err = ErrPublished
+		return
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return expvarStats{m.Stats(), m.Len()}
+	}))
+	return
+}
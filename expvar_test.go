@@ -0,0 +1,38 @@
+package tcache
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// expvarRuns makes the names published by every run of the test unique, as
+// they can't be unpublished
+var expvarRuns int64
+
+func TestPublishExpvar(t *testing.T) {
+	name := "tcache_test_" + strconv.FormatInt(atomic.AddInt64(&expvarRuns, 1), 10)
+	cache, _ := New(getMd5Value, WithStats())
+	if err := cache.PublishExpvar(name); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if err := cache.PublishExpvar(name); err != ErrPublished {
+		t.Fatalf("error: %v, want %v", err, ErrPublished)
+	}
+	cache.Get("1")
+	cache.Get("1")
+
+	var published struct {
+		Hits   uint64
+		Misses uint64
+		Len    int
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &published); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if published.Hits != 1 || published.Misses != 1 || published.Len != 1 {
+		t.Fatalf("published: %+v, want a hit, a miss and 1 item", published)
+	}
+}
@@ -0,0 +1,30 @@
+package tcache
+
+// like Get, but also returns the value's gen, which changes every time key is
+// written to, by a fetch, Set or anything else. Gens only ever grow and are
+// never reused, not even for a key that was deleted and stored again, so
+// SetIfGen can tell whether key was written to since
+func (m *Cache) GetWithGen(key string) (value interface{}, gen uint64, err error) {
+	e, _, err := m.doFetch(key, false, m.currentFetch())
+	return m.copyValue(e.value), e.gen, err
+}
+
+// stores value for key only if key's gen is still gen, a cheaper
+// CompareAndSwap for callers that keep the gen from GetWithGen around instead
+// of the whole value. swapped is false if key isn't cached, has expired or
+// was written to since. Like Set, value wins over a fetch in flight for key
+func (m *Cache) SetIfGen(key string, value interface{}, gen uint64) (swapped bool, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	e, ok := s.items[key]
+	if !ok || e.expired(m.now()) || e.gen != gen {
+		return
+	}
+	m.overrideFetch(key, s.store(key, value))
+	swapped = true
+	return
+}
@@ -0,0 +1,34 @@
+package tcache
+
+import "testing"
+
+func TestSetIfGen(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	value, gen, err := cache.GetWithGen("1")
+	if err != nil || !checkKey("1", value.(string)) || gen == 0 {
+		t.Fatalf("value: %v, gen: %d, error: %v, want the md5 of 1 with a gen", value, gen, err)
+	}
+	if swapped, err := cache.SetIfGen("1", "one", gen); !swapped || err != nil {
+		t.Fatalf("swapped: %v, error: %v, want true, nil", swapped, err)
+	}
+	value, newGen, _ := cache.GetWithGen("1")
+	if value != "one" || newGen <= gen {
+		t.Fatalf("value: %v, gen: %d, want one with a gen above %d", value, newGen, gen)
+	}
+
+	// a stale gen loses, even once the key is deleted and stored again
+	if swapped, _ := cache.SetIfGen("1", "lost", gen); swapped {
+		t.Fatal("swapped: true, want false for a stale gen")
+	}
+	cache.Delete("1")
+	if swapped, _ := cache.SetIfGen("1", "lost", newGen); swapped {
+		t.Fatal("swapped: true, want false for a deleted key")
+	}
+	cache.Set("1", "one again")
+	if swapped, _ := cache.SetIfGen("1", "lost", newGen); swapped {
+		t.Fatal("swapped: true, want false for a key stored again")
+	}
+	if value, _ := cache.Get("1"); value != "one again" {
+		t.Fatalf("value: %v, want one again", value)
+	}
+}
@@ -0,0 +1,71 @@
+package tcache
+
+import "time"
+
+// retainGeneration keeps the current items around as the previous generation
+// if the cache was created WithPreviousGeneration, replacing any older one.
+// Must be called with every shard locked, before they're reset
+func (m *Cache) retainGeneration() {
+	if m.keepPrevious <= 0 {
+		return
+	}
+	previous := make(map[string]*entry)
+	for _, s := range m.shards {
+		for k, e := range s.items {
+			previous[k] = e
+		}
+	}
+
+	m.generationLock.Lock()
+	m.generation++
+	generation := m.generation
+	m.previous = previous
+	m.generationLock.Unlock()
+
+	time.AfterFunc(m.keepPrevious, func() {
+		m.generationLock.Lock()
+		if m.generation == generation {
+			m.previous = nil
+		}
+		m.generationLock.Unlock()
+	})
+}
+
+// fromPreviousGeneration serves a miss from the previous generation if key
+// was in it and hasn't expired, fetching key again in the background unless
+// it's already being fetched or has been since
+func (m *Cache) fromPreviousGeneration(key string) (e entry, ok bool) {
+	m.generationLock.Lock()
+	old, ok := m.previous[key]
+	ok = ok && !old.expired(m.now())
+	if ok {
+		e = *old
+	}
+	generation := m.generation
+	m.generationLock.Unlock()
+	if !ok {
+		return
+	}
+	if _, inflight := m.calls.Load(key); inflight {
+		return
+	}
+
+	go func() {
+		fetched, err := m.fetchInBackground(key, func(entry) bool { return true })
+		if err != nil {
+			m.log("refreshing "+key+" from the previous generation", err)
+		}
+		if !fetched {
+			return
+		}
+		m.generationLock.Lock()
+		if m.generation == generation {
+			delete(m.previous, key)
+			if len(m.previous) == 0 {
+				m.previous = nil
+			}
+		}
+		m.generationLock.Unlock()
+	}()
+	return
+}
@@ -0,0 +1,66 @@
+package tcache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreviousGeneration(t *testing.T) {
+	var version int64 = 1
+	var fetches int64
+	cache, _ := New(func(key string) (interface{}, error) {
+		atomic.AddInt64(&fetches, 1)
+		return atomic.LoadInt64(&version), nil
+	}, WithPreviousGeneration(time.Minute))
+	cache.Get("1")
+	cache.Get("2")
+
+	atomic.StoreInt64(&version, 2)
+	cache.Clear()
+	if value, _ := cache.Get("1"); value != int64(1) {
+		t.Fatalf("value: %v, want the previous generation's 1", value)
+	}
+
+	// the background fetch replaces it
+	deadline := time.Now().Add(time.Second)
+	for value, _ := cache.TryGet("1"); value != int64(2); value, _ = cache.TryGet("1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("value: %v, want 1 fetched again", value)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if value, _ := cache.Get("1"); value != int64(2) {
+		t.Fatalf("value: %v, want 2", value)
+	}
+
+	// a burst of misses on the previous generation fetches the key once
+	cache.Clear()
+	before := atomic.LoadInt64(&fetches)
+	for i := 0; i < 100; i++ {
+		if value, _ := cache.Get("1"); value != int64(2) {
+			t.Fatalf("value: %v, want 2", value)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt64(&fetches) - before; n != 1 {
+		t.Fatalf("fetches: %d, want 1", n)
+	}
+
+	// keys that weren't cached before are fetched as usual
+	if value, _ := cache.Get("3"); value != int64(2) {
+		t.Fatalf("value: %v, want 2", value)
+	}
+
+	// the previous generation is dropped after the timeout
+	cache, _ = New(func(key string) (interface{}, error) {
+		return atomic.LoadInt64(&version), nil
+	}, WithPreviousGeneration(time.Millisecond))
+	cache.Get("1")
+	atomic.StoreInt64(&version, 3)
+	cache.Clear()
+	time.Sleep(20 * time.Millisecond)
+	if value, _ := cache.Get("1"); value != int64(3) {
+		t.Fatalf("value: %v, want 3 once the old generation is gone", value)
+	}
+}
@@ -0,0 +1,18 @@
+package tcache
+
+// like Get, but for caches created WithKeyFunc. keyObj is turned into its
+// string key by the key func and fetched with the fetch given to WithKeyFunc,
+// sharing the single-flight and everything else with Get for that string
+func (m *Cache) GetKey(keyObj interface{}) (value interface{}, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	if m.keyFunc == nil {
+		err = ErrNoKeyFunc
+		return
+	}
+	e, _, err := m.doFetch(m.keyFunc(keyObj), false, func(string) (interface{}, error) {
+		return m.keyFetch(keyObj)
+	})
+	return m.copyValue(e.value), err
+}
@@ -0,0 +1,45 @@
+package tcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGetKey(t *testing.T) {
+	type userKey struct {
+		org string
+		id  int
+	}
+	var fetched []userKey
+	cache, _ := New(getMd5Value, WithKeyFunc(func(keyObj interface{}) string {
+		k := keyObj.(userKey)
+		return fmt.Sprintf("%s/%d", k.org, k.id)
+	}, func(keyObj interface{}) (interface{}, error) {
+		k := keyObj.(userKey)
+		fetched = append(fetched, k)
+		return k.id, nil
+	}))
+
+	for i := 0; i < 2; i++ {
+		if value, err := cache.GetKey(userKey{"a", 1}); err != nil || value != 1 {
+			t.Fatalf("value: %v, error: %v, want 1", value, err)
+		}
+	}
+	cache.GetKey(userKey{"b", 1})
+	if len(fetched) != 2 || fetched[0] != (userKey{"a", 1}) {
+		t.Fatalf("fetched: %v, want the original keys, once each", fetched)
+	}
+
+	// the derived key is an ordinary string key
+	if value, _ := cache.Get("a/1"); value != 1 {
+		t.Fatalf("value: %v, want 1", value)
+	}
+	if value, _ := cache.Get("2"); !checkKey("2", value.(string)) {
+		t.Fatalf("value: %v, Get still uses the fetch passed to New", value)
+	}
+
+	cache, _ = New(getMd5Value)
+	if _, err := cache.GetKey(userKey{"a", 1}); err != ErrNoKeyFunc {
+		t.Fatalf("error: %v, want %v", err, ErrNoKeyFunc)
+	}
+}
@@ -0,0 +1,82 @@
+package tcache
+
+import "container/list"
+
+// EvictionPolicy decides which item a bounded cache evicts to make room
+type EvictionPolicy int
+
+const (
+	// PolicyLRU evicts the least recently used item
+	PolicyLRU EvictionPolicy = iota
+	// PolicyLFU evicts the least frequently used item, the least recently
+	// used one amongst those used equally often
+	PolicyLFU
+	// PolicyFIFO evicts the item that was inserted first. Reads aren't
+	// tracked, so hits on a bounded cache only take the read lock, and
+	// overwriting an item keeps its place
+	PolicyFIFO
+)
+
+// frequency holds every entry used count times, the most recently used at
+// the front. shard.freqs keeps them in ascending count order so the victim
+// is always at the back of the first one, and every operation is O(1). All of
+// these must be called with the shard's itemsLock held for writing.
+type frequency struct {
+	count   int
+	entries *list.List
+}
+
+// lfuInsert tracks a new entry as used once
+func (s *shard) lfuInsert(key string, e *entry) {
+	front := s.freqs.Front()
+	if front == nil || front.Value.(*frequency).count != 1 {
+		front = s.freqs.PushFront(&frequency{count: 1, entries: list.New()})
+	}
+	e.freq = front
+	e.elem = front.Value.(*frequency).entries.PushFront(key)
+}
+
+// lfuTouch moves e up to the next frequency
+func (s *shard) lfuTouch(e *entry) {
+	cur := e.freq
+	f := cur.Value.(*frequency)
+	next := cur.Next()
+	if next == nil || next.Value.(*frequency).count != f.count+1 {
+		next = s.freqs.InsertAfter(&frequency{count: f.count + 1, entries: list.New()}, cur)
+	}
+	key := f.entries.Remove(e.elem)
+	e.freq = next
+	e.elem = next.Value.(*frequency).entries.PushFront(key)
+	if f.entries.Len() == 0 {
+		s.freqs.Remove(cur)
+	}
+}
+
+// lfuRemove stops tracking e
+func (s *shard) lfuRemove(e *entry) {
+	f := e.freq.Value.(*frequency)
+	f.entries.Remove(e.elem)
+	if f.entries.Len() == 0 {
+		s.freqs.Remove(e.freq)
+	}
+	e.freq = nil
+}
+
+// lfuVictim returns the element of the entry to evict, nil when empty. keep,
+// if not nil, is the entry just stored, which is only picked when there's
+// nothing else. It's used once, so it'd otherwise be the victim whenever
+// every other entry has been used more often, and no new key could ever
+// stay long enough to become hot
+func (s *shard) lfuVictim(keep *entry) *list.Element {
+	for f := s.freqs.Front(); f != nil; f = f.Next() {
+		for elem := f.Value.(*frequency).entries.Back(); elem != nil; elem = elem.Prev() {
+			if keep == nil || elem != keep.elem {
+				return elem
+			}
+		}
+	}
+	if keep != nil {
+		return keep.elem
+	}
+	return nil
+}
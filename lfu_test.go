@@ -0,0 +1,55 @@
+package tcache
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLFU(t *testing.T) {
+	cache, _ := New(getMd5Value, WithMaxEntries(2), WithEvictionPolicy(PolicyLFU))
+	cache.Get("1")
+	cache.Get("1")
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("3") // 2 and 3 were used once, 2 less recently
+	if cache.Has("2") || !cache.Has("1") || !cache.Has("3") {
+		t.Fatalf("keys: %v, want 2 evicted", cache.Keys())
+	}
+
+	// a burst of one-off keys doesn't push out the hot one
+	for _, key := range []string{"4", "5", "6", "7"} {
+		cache.Get(key)
+	}
+	if !cache.Has("1") || !cache.Has("7") {
+		t.Fatalf("keys: %v, want [1 7]", cache.Keys())
+	}
+
+	cache.Delete("7")
+	cache.Clear()
+	cache.Get("8")
+	cache.Get("9")
+	if cache.Len() != 2 || cache.shards[0].freqs.Len() != 1 {
+		t.Fatalf("len: %d, frequencies: %d, want 2 and 1", cache.Len(), cache.shards[0].freqs.Len())
+	}
+
+	// a new key doesn't evict itself when every other one is hot
+	cache, _ = New(getMd5Value, WithMaxEntries(2), WithEvictionPolicy(PolicyLFU), WithStats())
+	for _, key := range []string{"a", "a", "b", "b"} {
+		cache.Get(key)
+	}
+	for i := 0; i < 5; i++ {
+		cache.Get("c")
+	}
+	if stats := cache.Stats(); stats.Fetches != 3 || !cache.Has("c") {
+		t.Fatalf("fetches: %d, keys: %v, want c fetched once and cached", stats.Fetches, cache.Keys())
+	}
+
+	// evicting while slammed, run with -race
+	cache, _ = New(getMd5Value, WithMaxEntries(5), WithEvictionPolicy(PolicyLFU))
+	wg := &sync.WaitGroup{}
+	slam1To10ALot(cache, wg)
+	wg.Wait()
+	if n := cache.Len(); n != 5 {
+		t.Fatalf("len: %d, want 5", n)
+	}
+}
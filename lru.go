@@ -0,0 +1,235 @@
+package tcache
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+)
+
+// recency tracking for caches created with a maxEntries or maxBytes limit.
+// The front of s.lru is the most recently used entry, or the most recently
+// inserted one with PolicyFIFO. All of these must be called with the shard's
+// itemsLock held for writing.
+
+// store inserts or overwrites a value with the default ttl
+func (s *shard) store(key string, value interface{}) *entry {
+	return s.storeUntil(key, value, s.cache.expiry())
+}
+
+// storeUntil inserts or overwrites a value expiring at expiresAt and evicts
+// the least recently used entries if the shard has grown past maxEntries or
+// maxBytes. A value bigger than maxBytes on its own ends up evicting itself
+func (s *shard) storeUntil(key string, value interface{}, expiresAt time.Time) *entry {
+	e, ok := s.items[key]
+	if !ok {
+		e = &entry{}
+		s.items[key] = e
+	} else if e.expired(s.cache.now()) {
+		s.cache.count(&s.cache.stats.evictions)
+		s.evicted(key, e, ReasonTTL)
+	}
+	e.value = value
+	e.meta = nil
+	e.storedAt = s.cache.now()
+	e.gen = atomic.AddUint64(&s.cache.lastGen, 1)
+	e.expiresAt = expiresAt
+	e.refreshAt = s.cache.softExpiry()
+	s.stored(key, value)
+	if !s.bounded() {
+		return e
+	}
+	if s.maxBytes > 0 {
+		size := int64(len(key)) + s.cache.sizer(value)
+		s.bytes += size - e.size
+		e.size = size
+	}
+	if e.elem != nil {
+		s.touch(e)
+	} else if s.cache.policy == PolicyLFU {
+		s.lfuInsert(key, e)
+	} else {
+		e.elem = s.lru.PushFront(key)
+	}
+	for s.full() {
+		s.evictOldest(e)
+	}
+	return e
+}
+
+// bounded reports whether the shard has a limit to evict for
+func (s *shard) bounded() bool {
+	return s.maxEntries > 0 || s.maxBytes > 0
+}
+
+// tracksReads reports whether a hit has to update the shard's eviction order
+func (s *shard) tracksReads() bool {
+	return s.bounded() && s.cache.policy != PolicyFIFO
+}
+
+// needsTouch reports whether a hit on e has to update the eviction order or
+// the expiry, which takes the write lock. The most recently used entry of an
+// lru is already where a hit would move it. Resize can change whether the
+// shard is bounded, so this must be called with itemsLock held
+func (s *shard) needsTouch(e *entry) bool {
+	if s.cache.sliding && !e.expiresAt.IsZero() && s.cache.ttl > 0 {
+		return true
+	}
+	if !s.tracksReads() || e.elem == nil {
+		return false
+	}
+	return s.cache.policy == PolicyLFU || s.lru.Front() != e.elem
+}
+
+// full reports whether the shard is past one of its limits
+func (s *shard) full() bool {
+	if len(s.items) == 0 {
+		return false
+	}
+	return (s.maxEntries > 0 && len(s.items) > s.maxEntries) ||
+		(s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+// touch marks e as the most recently used, or as used once more for lfu. The
+// insertion order of fifo doesn't change
+func (s *shard) touch(e *entry) {
+	switch {
+	case e.elem == nil, s.cache.policy == PolicyFIFO:
+	case s.cache.policy == PolicyLFU:
+		s.lfuTouch(e)
+	default:
+		s.lru.MoveToFront(e.elem)
+	}
+}
+
+// evictOldest evicts the entry the eviction policy picks, other than keep if
+// there's anything else, see lfuVictim
+func (s *shard) evictOldest(keep *entry) {
+	var elem *list.Element
+	if s.cache.policy == PolicyLFU {
+		elem = s.lfuVictim(keep)
+	} else {
+		elem = s.lru.Back()
+	}
+	if elem == nil {
+		return
+	}
+	key := elem.Value.(string)
+	s.cache.count(&s.cache.stats.evictions)
+	s.remove(key, s.items[key], ReasonCapacity)
+}
+
+// remove drops e from the shard, evicting it for reason
+func (s *shard) remove(key string, e *entry, reason EvictReason) {
+	switch {
+	case e.elem == nil:
+	case s.cache.policy == PolicyLFU:
+		s.lfuRemove(e)
+	default:
+		s.lru.Remove(e.elem)
+	}
+	s.bytes -= e.size
+	delete(s.items, key)
+	s.evicted(key, e, reason)
+}
+
+// forEach calls fn for every item in eviction order when the shard is
+// bounded, returning false if fn did. Only needs the read lock
+func (s *shard) forEach(fn func(key string, e *entry) bool) bool {
+	if !s.bounded() {
+		for k, e := range s.items {
+			if !fn(k, e) {
+				return false
+			}
+		}
+		return true
+	}
+	if s.cache.policy == PolicyLFU {
+		for f := s.freqs.Front(); f != nil; f = f.Next() {
+			if !forEachBackwards(f.Value.(*frequency).entries, s.items, fn) {
+				return false
+			}
+		}
+		return true
+	}
+	return forEachBackwards(s.lru, s.items, fn)
+}
+
+// forEachBackwards calls fn for the entry of every key in l, from the back
+func forEachBackwards(l *list.List, items map[string]*entry, fn func(key string, e *entry) bool) bool {
+	for elem := l.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(string)
+		if !fn(key, items[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// changes the WithMaxEntries limit without recreating the cache, evicting
+// the least recently used items straight away if there are more than
+// maxEntries, with OnEvict callbacks firing for each of them. 0 means
+// unbounded. Like WithMaxEntries, the limit is split between the shards
+func (m *Cache) Resize(maxEntries int) {
+	m.lockAll()
+	defer m.unlockAll()
+	m.maxEntries = maxEntries
+	perShard := 0
+	if n := len(m.shards); n > 0 && maxEntries > 0 {
+		perShard = (maxEntries + n - 1) / n
+	}
+	for _, s := range m.shards {
+		wasBounded := s.bounded()
+		s.maxEntries = perShard
+		switch {
+		case !wasBounded && s.bounded():
+			s.trackAll()
+		case wasBounded && !s.bounded():
+			s.untrackAll()
+		}
+		for s.full() {
+			s.evictOldest(nil)
+		}
+	}
+}
+
+// trackAll starts tracking the recency of every item when the shard becomes
+// bounded. The items weren't tracked so far, they're ordered at random
+func (s *shard) trackAll() {
+	for k, e := range s.items {
+		if s.cache.policy == PolicyLFU {
+			s.lfuInsert(k, e)
+		} else {
+			e.elem = s.lru.PushFront(k)
+		}
+	}
+}
+
+// untrackAll stops tracking the recency of every item when the shard becomes
+// unbounded, lookups only read lock unbounded shards
+func (s *shard) untrackAll() {
+	for _, e := range s.items {
+		e.elem = nil
+		e.freq = nil
+	}
+	s.resetLRU()
+}
+
+// resetLRU drops all recency and size information, used whenever items is
+// replaced
+func (s *shard) resetLRU() {
+	s.lru = list.New()
+	s.freqs = list.New()
+	s.bytes = 0
+}
+
+// sizeOf is the default sizer for WithMaxBytes, strings and byte slices are
+// their length and anything else is 0
+func sizeOf(value interface{}) int64 {
+	switch v := value.(type) {
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	}
+	return 0
+}
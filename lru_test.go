@@ -0,0 +1,260 @@
+package tcache
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxEntries(t *testing.T) {
+	cache, _ := New(getMd5Value, WithMaxEntries(2))
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("1") // 2 is now the least recently used
+	cache.Get("3")
+	items := cache.GetAll()
+	if len(items) != 2 {
+		t.Fatalf("len: %d, want 2", len(items))
+	}
+	if _, ok := items["2"]; ok {
+		t.Fatalf("values: %v, 2 should have been evicted", items)
+	}
+	for _, key := range []string{"1", "3"} {
+		if !checkKey(key, items[key].(string)) {
+			t.Fatalf("key %s, value %v, want %s", key, items[key], computeMD5(key))
+		}
+	}
+
+	// Update counts as a use too
+	cache.Update("1")
+	cache.Get("4")
+	if _, ok := cache.GetAll()["3"]; ok {
+		t.Fatalf("values: %v, 3 should have been evicted", cache.GetAll())
+	}
+
+	// a prewarmed map bigger than the limit gets trimmed
+	cache, _ = New(getMd5Value, WithPreWarm(preWarm), WithMaxEntries(5))
+	if n := len(cache.GetAll()); n != 5 {
+		t.Fatalf("len: %d, want 5", n)
+	}
+
+	// evicting while slammed, run with -race
+	cache, _ = New(getMd5Value, WithMaxEntries(5))
+	wg := &sync.WaitGroup{}
+	slam1To10ALot(cache, wg)
+	wg.Wait()
+	if n := len(cache.GetAll()); n != 5 {
+		t.Fatalf("len: %d, want 5", n)
+	}
+
+	// 0 means unbounded
+	cache, _ = New(getMd5Value)
+	for i := 0; i < 100; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	if n := len(cache.GetAll()); n != 100 {
+		t.Fatalf("len: %d, want 100", n)
+	}
+}
+
+func TestMaxEntriesClear(t *testing.T) {
+	cache, _ := New(getMd5Value, WithMaxEntries(2))
+	cache.Get("1")
+	cache.Get("2")
+	cache.Clear()
+	cache.Get("3")
+	cache.Get("4")
+	if n := len(cache.GetAll()); n != 2 {
+		t.Fatalf("len: %d, want 2", n)
+	}
+	if cache.shards[0].lru.Len() != 2 {
+		t.Fatalf("lru len: %d, want 2", cache.shards[0].lru.Len())
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	// md5 values are 32 bytes, plus a 1 byte key
+	cache, _ := New(getMd5Value, WithMaxBytes(70))
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("1") // 2 is now the least recently used
+	if stats := cache.Stats(); stats.Bytes != 66 {
+		t.Fatalf("bytes: %d, want 66", stats.Bytes)
+	}
+	cache.Get("3")
+	if cache.Has("2") || !cache.Has("1") || !cache.Has("3") {
+		t.Fatalf("keys: %v, want 2 evicted", cache.Keys())
+	}
+
+	// overwriting adjusts the size, an item bigger than the budget isn't kept
+	cache.Set("1", "x")
+	if stats := cache.Stats(); stats.Bytes != 35 {
+		t.Fatalf("bytes: %d, want 35", stats.Bytes)
+	}
+	cache.Set("big", strings.Repeat("x", 100))
+	if cache.Len() != 0 || cache.Stats().Bytes != 0 {
+		t.Fatalf("keys: %v, want everything evicted for the big item", cache.Keys())
+	}
+
+	cache, _ = New(getMd5Value, WithMaxBytes(10), WithSizer(func(value interface{}) int64 {
+		return 4
+	}))
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("3")
+	if cache.Len() != 2 {
+		t.Fatalf("len: %d, want 2 items of 5 bytes", cache.Len())
+	}
+	cache.Delete("2")
+	cache.Clear()
+	if stats := cache.Stats(); stats.Bytes != 0 {
+		t.Fatalf("bytes: %d, want 0 once empty", stats.Bytes)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	cache, _ := New(getMd5Value, WithMaxEntries(3))
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("3")
+	cache.Get("1")
+	var keys []string
+	cache.ForEach(func(key string, value interface{}) bool {
+		if !checkKey(key, value.(string)) {
+			t.Fatalf("key %s, value %v, want %s", key, value, computeMD5(key))
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if strings.Join(keys, ",") != "2,3,1" {
+		t.Fatalf("keys: %v, want least to most recently used", keys)
+	}
+
+	// stopping early
+	keys = nil
+	cache.ForEach(func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return false
+	})
+	if len(keys) != 1 {
+		t.Fatalf("keys: %v, want only the first", keys)
+	}
+
+	// lfu goes from the least frequently used
+	cache, _ = New(getMd5Value, WithMaxEntries(3), WithEvictionPolicy(PolicyLFU))
+	cache.Get("1")
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("3")
+	keys = nil
+	cache.ForEach(func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if strings.Join(keys, ",") != "2,3,1" {
+		t.Fatalf("keys: %v, want least to most frequently used", keys)
+	}
+
+	// unbounded caches still visit everything
+	cache, _ = New(getMd5Value, WithPreWarm(preWarm))
+	n := 0
+	cache.ForEach(func(key string, value interface{}) bool {
+		n++
+		return true
+	})
+	if n != len(preWarmMap) {
+		t.Fatalf("visited: %d, want %d", n, len(preWarmMap))
+	}
+}
+
+func TestResize(t *testing.T) {
+	cache, _ := New(getMd5Value, WithMaxEntries(5))
+	evicted := &recorder{}
+	cache.OnEvict(evicted.record)
+	for i := 1; i <= 5; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	cache.Get("1")
+	cache.Resize(3)
+	if keys := evicted.take(); len(keys) != 2 || keys[0] != "2" || keys[1] != "3" {
+		t.Fatalf("evicted: %v, want the least recently used 2 and 3", keys)
+	}
+	cache.Get("6")
+	if n := cache.Len(); n != 3 {
+		t.Fatalf("len: %d, want 3", n)
+	}
+
+	// unbounded and back
+	cache.Resize(0)
+	for i := 1; i <= 10; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	if n := cache.Len(); n != 10 {
+		t.Fatalf("len: %d, want 10 once unbounded", n)
+	}
+	evicted.take()
+	cache.Resize(4)
+	if n, keys := cache.Len(), evicted.take(); n != 4 || len(keys) != 6 {
+		t.Fatalf("len: %d, evicted: %v, want 4 left and 6 evicted", n, keys)
+	}
+
+	// an unbounded cache, sharded, becomes bounded while it's being used
+	cache, _ = New(getMd5Value, WithShards(2))
+	wg := &sync.WaitGroup{}
+	slam1To10ALot(cache, wg)
+	cache.Resize(4)
+	wg.Wait()
+	if n := cache.Len(); n > 4 {
+		t.Fatalf("len: %d, want at most 4", n)
+	}
+
+	// the callbacks are free to use the cache, every shard included
+	cache, _ = New(getMd5Value, WithShards(4))
+	for i := 0; i < 100; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	cache.OnEvict(func(key string, value interface{}) {
+		cache.Has("57")
+	})
+	var observed int
+	cache.evictObserver = func(key string, value interface{}, reason EvictReason) {
+		cache.Len()
+		observed++
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.Resize(10)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlocked")
+	}
+	if n := cache.Len(); observed != 100-n {
+		t.Fatalf("observed: %d, want %d evictions", observed, 100-n)
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	cache, _ := New(getMd5Value, WithMaxEntries(2), WithEvictionPolicy(PolicyFIFO))
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("1")
+	cache.Set("1", "one") // neither a hit nor an overwrite moves 1
+	cache.Get("3")
+	if cache.Has("1") || !cache.Has("2") || !cache.Has("3") {
+		t.Fatalf("keys: %v, want 1 evicted", cache.Keys())
+	}
+
+	// evicting while slammed, run with -race
+	cache, _ = New(getMd5Value, WithMaxEntries(5), WithEvictionPolicy(PolicyFIFO))
+	wg := &sync.WaitGroup{}
+	slam1To10ALot(cache, wg)
+	wg.Wait()
+	if n := cache.Len(); n != 5 {
+		t.Fatalf("len: %d, want 5", n)
+	}
+}
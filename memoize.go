@@ -0,0 +1,9 @@
+package tcache
+
+// wraps fn in a cache, returning the cache along with a drop in replacement
+// for fn that only calls it once per key
+func Memoize(fn func(string) (interface{}, error)) (cache *Cache, memoized func(string) (interface{}, error)) {
+	// New only fails when prewarming
+	cache, _ = New(fn)
+	return cache, cache.Get
+}
@@ -0,0 +1,36 @@
+package tcache
+
+// like Set, but attaches meta to the entry, eg. which server the value came
+// from. The metadata stays with the entry until it's replaced, by any kind of
+// store including a fetch, and is handed to OnEvictWithMeta callbacks. The
+// cache keeps its own copy of meta
+func (m *Cache) SetWithMeta(key string, value interface{}, meta map[string]string) (err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	e := s.store(key, value)
+	e.meta = copyMeta(meta)
+	m.overrideFetch(key, e)
+	return
+}
+
+// like Get, but also returns a copy of the metadata stored with SetWithMeta,
+// nil if there is none
+func (m *Cache) GetWithMeta(key string) (value interface{}, meta map[string]string, err error) {
+	e, _, err := m.doFetch(key, false, m.currentFetch())
+	return m.copyValue(e.value), copyMeta(e.meta), err
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(meta))
+	for k, v := range meta {
+		copied[k] = v
+	}
+	return copied
+}
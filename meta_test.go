@@ -0,0 +1,42 @@
+package tcache
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	meta := map[string]string{"server": "a"}
+	cache.SetWithMeta("1", "one", meta)
+	meta["server"] = "changed"
+
+	value, got, err := cache.GetWithMeta("1")
+	want := map[string]string{"server": "a"}
+	if err != nil || value != "one" || !reflect.DeepEqual(got, want) {
+		t.Fatalf("value: %v, meta: %v, error: %v, want one with %v", value, got, err, want)
+	}
+	got["server"] = "changed"
+	if _, got, _ := cache.GetWithMeta("1"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("meta: %v, want %v", got, want)
+	}
+
+	// fetched values have none
+	if value, got, _ := cache.GetWithMeta("2"); !checkKey("2", value.(string)) || got != nil {
+		t.Fatalf("value: %v, meta: %v, want no meta", value, got)
+	}
+
+	// the metadata goes along to the eviction callbacks, and is dropped when
+	// the value is replaced
+	var evicted []map[string]string
+	cache.OnEvictWithMeta(func(key string, value interface{}, meta map[string]string) {
+		evicted = append(evicted, meta)
+	})
+	cache.Delete("1")
+	cache.SetWithMeta("3", "three", want)
+	cache.Set("3", "three again")
+	cache.Delete("3")
+	if !reflect.DeepEqual(evicted, []map[string]string{want, nil}) {
+		t.Fatalf("evicted meta: %v, want %v and nil", evicted, want)
+	}
+}
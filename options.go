@@ -0,0 +1,395 @@
+package tcache
+
+import "time"
+
+// Option configures a Cache created by New
+type Option func(*Cache)
+
+// WithPreWarm fills the cache with the items returned by preWarmInit when it's
+// created, New returns the error if preWarmInit fails
+func WithPreWarm(preWarmInit func() (map[string]interface{}, error)) Option {
+	return func(m *Cache) {
+		m.preWarmInit = preWarmInit
+	}
+}
+
+// WithName names the cache, to tell caches apart in metrics and in the
+// errors the cache itself returns. Unnamed caches return the bare errors
+func WithName(name string) Option {
+	return func(m *Cache) {
+		m.name = name
+	}
+}
+
+// WithKeyFunc lets GetKey take any kind of key. keyFunc derives the string
+// the item is cached under and fetch is called with the original key on a
+// miss. Two keys that keyFunc maps to the same string are the same item, so
+// keyFunc has to tell apart every key that should be cached separately. Get
+// and friends keep using the string keys and the fetch passed to New
+func WithKeyFunc(keyFunc func(keyObj interface{}) string, fetch func(keyObj interface{}) (interface{}, error)) Option {
+	return func(m *Cache) {
+		m.keyFunc = keyFunc
+		m.keyFetch = fetch
+	}
+}
+
+// WithArgFetch lets GetWithArg pass an extra arg, eg. a tenant or request
+// options, to fetch on a miss. Values are still cached by key only, see
+// GetWithArg. Get and friends keep using the fetch passed to New
+func WithArgFetch(fetch func(key string, arg interface{}) (interface{}, error)) Option {
+	return func(m *Cache) {
+		m.argFetch = fetch
+	}
+}
+
+// WithBackingStore puts store behind the cache as a second tier, eg. one
+// shared by several instances. See Store for how it's used
+func WithBackingStore(store Store) Option {
+	return func(m *Cache) {
+		m.store = store
+	}
+}
+
+// WithWarmKeys gets every key in keys while the cache is created, fetching
+// them concurrently the same way GetMany does. A failing fetch doesn't stop
+// the others, New then returns the cache along with every fetch error joined
+// together, the keys that failed are simply not cached. See
+// WithWarmInBackground to not hold up New
+func WithWarmKeys(keys []string) Option {
+	return func(m *Cache) {
+		m.warmKeys = keys
+	}
+}
+
+// WithWarmProgress calls progress every time one of the keys given to
+// WithWarmKeys has been gotten, failed ones included, with how many are done
+// out of how many there are. Calls are never concurrent and done only goes
+// up. Keep it quick, warming waits on it
+func WithWarmProgress(progress func(done, total int)) Option {
+	return func(m *Cache) {
+		m.warmProgress = progress
+	}
+}
+
+// WithWarmInBackground makes New return without waiting for WithWarmKeys to
+// finish, and without its error. Use WaitWarm to wait for it instead
+func WithWarmInBackground() Option {
+	return func(m *Cache) {
+		m.warmInBackground = true
+	}
+}
+
+// WithTTL expires items ttl after they were stored, the next Get fetches them
+// again. 0 means items never expire
+func WithTTL(ttl time.Duration) Option {
+	return func(m *Cache) {
+		m.ttl = ttl
+	}
+}
+
+// WithSlidingExpiration(true) makes every hit restart the item's ttl, like
+// Touch, so items only expire once they haven't been gotten for a whole ttl.
+// Has and TryGet don't count as hits
+func WithSlidingExpiration(sliding bool) Option {
+	return func(m *Cache) {
+		m.sliding = sliding
+	}
+}
+
+// WithTTLJitter randomizes every ttl by up to ±fraction of it, so items
+// stored at the same time, eg. by WithPreWarm, don't all expire and get
+// fetched again at once. 0.1 makes a one minute ttl anywhere from 54 to 66
+// seconds
+func WithTTLJitter(fraction float64) Option {
+	return func(m *Cache) {
+		m.ttlJitter = fraction
+	}
+}
+
+// WithSoftTTL refreshes items d after they were stored, before WithTTL's ttl
+// expires them. A get between the two still gets the cached value straight
+// away and starts a single background fetch of the key, once the ttl is past
+// the item is gone and gets wait on a fetch like for any other miss. Without
+// a ttl items are refreshed every d but never expire
+func WithSoftTTL(d time.Duration) Option {
+	return func(m *Cache) {
+		m.softTTL = d
+	}
+}
+
+// WithPreviousGeneration keeps serving the items that were cached before a
+// Clear or PurgeAndInit for up to d afterwards, so a hot cache that's cleared
+// doesn't miss on every key at once. Such a miss gets the old value straight
+// away and the key is fetched again in the background, once it's fetched the
+// old value is dropped. Don't use it if Clear is meant to get rid of bad
+// values right away
+func WithPreviousGeneration(d time.Duration) Option {
+	return func(m *Cache) {
+		m.keepPrevious = d
+	}
+}
+
+// WithCleanupInterval sweeps the cache for expired items every interval,
+// instead of leaving them around until they're asked for again. OnEvict
+// callbacks fire for each of them. Call Close to stop the sweeping
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(m *Cache) {
+		m.cleanupInterval = interval
+	}
+}
+
+// WithStaleRetention has WithCleanupInterval's janitor leave expired items
+// around for d past their expiry, so GetWithFallback still has them to fall
+// back on. They're never served by Get, and without the janitor expired items
+// stay until they're fetched again or evicted anyway
+func WithStaleRetention(d time.Duration) Option {
+	return func(m *Cache) {
+		m.staleRetention = d
+	}
+}
+
+// WithMaxEntries bounds the number of cached items, evicting the least
+// recently used ones past that limit. 0 means unbounded
+func WithMaxEntries(maxEntries int) Option {
+	return func(m *Cache) {
+		m.maxEntries = maxEntries
+	}
+}
+
+// WithMaxBytes bounds the estimated size of the cached items, evicting the
+// least recently used ones until a new item fits. An item is its key's length
+// plus whatever the sizer from WithSizer says its value is. 0 means unbounded
+func WithMaxBytes(n int64) Option {
+	return func(m *Cache) {
+		m.maxBytes = n
+	}
+}
+
+// WithSizer estimates how many bytes a value takes up for WithMaxBytes. The
+// default sizes strings and byte slices by their length and anything else
+// as 0
+func WithSizer(sizer func(value interface{}) int64) Option {
+	return func(m *Cache) {
+		m.sizer = sizer
+	}
+}
+
+// WithEvictionObserver calls observer for every entry that leaves the cache,
+// along with why. Like OnEvict it runs once the cache's locks are released.
+// With a limit high enough to rarely kick in it shows what a lower one would
+// evict before committing to it
+func WithEvictionObserver(observer func(key string, value interface{}, reason EvictReason)) Option {
+	return func(m *Cache) {
+		m.evictObserver = observer
+	}
+}
+
+// WithEvictionPolicy picks which item goes when WithMaxEntries or
+// WithMaxBytes needs room, PolicyLRU by default
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(m *Cache) {
+		m.policy = policy
+	}
+}
+
+// WithStats turns on the counters returned by Stats. They're off by default so
+// caches that don't need them don't pay for the atomic operations
+func WithStats() Option {
+	return func(m *Cache) {
+		m.statsEnabled = true
+	}
+}
+
+// WithMaxConcurrentFetches limits how many fetches, across all keys, run at
+// the same time. Misses past the limit block until a fetch finishes. 0 means
+// unlimited
+func WithMaxConcurrentFetches(n int) Option {
+	return func(m *Cache) {
+		if n > 0 {
+			m.fetchSem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithFetchRateLimit caps fetches, across all keys and retries included, at
+// rps a second on average, allowing bursts of up to burst fetches. A fetch
+// over the limit waits for its turn, unless that would take longer than
+// WithFetchTimeout's timeout in which case it gives up with ErrFetchTimeout
+// straight away
+func WithFetchRateLimit(rps float64, burst int) Option {
+	return func(m *Cache) {
+		if rps > 0 {
+			m.limiter = newLimiter(rps, burst)
+		}
+	}
+}
+
+// WithFetchTimeout gives up on a fetch that takes longer than d, returning
+// ErrFetchTimeout and releasing the key so later gets can try again. The
+// abandoned fetch keeps running in the background, its result is dropped
+func WithFetchTimeout(d time.Duration) Option {
+	return func(m *Cache) {
+		m.fetchTimeout = d
+	}
+}
+
+// WithConditionalFetch replaces the fetch passed to New, which can then be
+// nil, with one that's also handed the value currently cached for key, nil if
+// there's none, even when it has expired. Returning unchanged keeps current,
+// giving it a fresh ttl, eg. when upstream answers "not modified". current is
+// the cached value itself and mustn't be mutated
+func WithConditionalFetch(fetch func(key string, current interface{}) (value interface{}, unchanged bool, err error)) Option {
+	return func(m *Cache) {
+		m.conditionalFetch = fetch
+	}
+}
+
+// WithMultiFetch replaces the fetch passed to New, which can then be nil, with
+// one that can return extra items along with the value for key, eg. from an
+// upstream that answers for several related keys at once. The extra items
+// are cached as if they had been Set, so gets waiting on a fetch of one of
+// them get it too. Nothing in extra is cached if err isn't nil
+func WithMultiFetch(fetch func(key string) (value interface{}, extra map[string]interface{}, err error)) Option {
+	return func(m *Cache) {
+		m.multiFetch = fetch
+	}
+}
+
+// WithTransform passes every value fetch returns through transform before
+// it's cached, eg. to normalize values without repeating that in every
+// fetch. A transform error is treated like a fetch error, nothing is cached
+// and it's returned. Values stored with Set and friends aren't transformed
+func WithTransform(transform func(key string, value interface{}) (interface{}, error)) Option {
+	return func(m *Cache) {
+		m.transform = transform
+	}
+}
+
+// WithFetchObserver calls observer after every fetch, retries included, with
+// how long it took and the error it returned, wrapped in a FetchError. It's
+// called without any locks held, from the goroutine that fetched, so it
+// delays the gets waiting on that fetch and should be quick. Counting the
+// calls per key tells how many fetches the single-flight let through
+func WithFetchObserver(observer func(key string, d time.Duration, err error)) Option {
+	return func(m *Cache) {
+		m.fetchObserver = observer
+	}
+}
+
+// WithLogger hands logger what the cache does in the background where no
+// caller would see it: fetches failing in StartRefresh, WithSoftTTL or
+// WithPreviousGeneration, what the WithCleanupInterval janitor removed, and
+// fetches that panicked. err is nil for messages that aren't about an error.
+// It's called from whichever goroutine did the work, without any locks
+// held. Nothing is logged by default
+func WithLogger(logger func(msg string, err error)) Option {
+	return func(m *Cache) {
+		m.logger = logger
+	}
+}
+
+// WithUpdateDebounce makes Update and Refresh wait d before fetching, so that
+// every other update of the same key arriving in the meantime shares that one
+// fetch and its result, eg. for a burst of webhooks about the same key.
+// Updates arriving once the fetch has started wait for the next one
+func WithUpdateDebounce(d time.Duration) Option {
+	return func(m *Cache) {
+		m.updateDebounce = d
+	}
+}
+
+// WithErrorBackoff stops gets from fetching a key whose last fetch failed for
+// base, doubling that with every consecutive failure up to max, so a key
+// that's broken upstream isn't hammered. Gets in the meantime return the
+// last fetch's error straight away. Update and Refresh always fetch, and the
+// first fetch that succeeds ends the backoff, as does not failing again for
+// max after it ran out
+func WithErrorBackoff(base, max time.Duration) Option {
+	return func(m *Cache) {
+		if base > 0 {
+			m.backoff = newBackoff(base, max)
+		}
+	}
+}
+
+// WithMaxHerdWait bounds how long a get waits on another get's fetch of the
+// same key. Past d it gives up with ErrHerdTimeout, or if fetchOnTimeout is
+// set it fetches the key itself, at the cost of fetching that key twice. 0
+// means waiting for as long as the fetch takes
+func WithMaxHerdWait(d time.Duration, fetchOnTimeout bool) Option {
+	return func(m *Cache) {
+		m.maxHerdWait = d
+		m.fetchOnHerdTimeout = fetchOnTimeout
+	}
+}
+
+// WithReentrancyCheck makes a fetch that gets its own key, directly or
+// through other keys' fetches, fail with ErrReentrantFetch instead of
+// deadlocking. It's a best-effort debugging aid: it reads the waiting
+// goroutine's stack trace whenever a fetch waits on another key, and relies
+// on how the runtime formats it. Without it such a fetch waits on itself for
+// good, or until WithMaxHerdWait gives up
+func WithReentrancyCheck() Option {
+	return func(m *Cache) {
+		m.reentrancyCheck = true
+	}
+}
+
+// WithSingleFlight(false) lets every get that misses fetch the key itself
+// instead of waiting on the fetch already running for it, for fetches so
+// cheap, eg. hashing the key, that coordinating them costs more than running
+// them twice. Gets of a key being fetched then all fetch it and the last one
+// stored wins, so fetch has to be idempotent. Everything else works the same
+func WithSingleFlight(singleFlight bool) Option {
+	return func(m *Cache) {
+		m.noSingleFlight = !singleFlight
+	}
+}
+
+// WithRetry tries a failing fetch up to attempts times, sleeping backoff
+// before the first retry and doubling it before each one after that. The
+// error of the last attempt is returned if they all fail
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(m *Cache) {
+		m.retryAttempts = attempts
+		m.retryBackoff = backoff
+	}
+}
+
+// WithShards splits the cache's items into n independently locked shards to
+// cut lock contention between writers. Unbounded caches default to 16 shards
+// and caches using WithMaxEntries or WithMaxBytes to 1. With more than one
+// shard the limits are split evenly between the shards, each evicting its own
+// least recently used items
+func WithShards(n int) Option {
+	return func(m *Cache) {
+		m.shardCount = n
+	}
+}
+
+// WithInitialCapacity makes room for n items up front, so filling the cache
+// doesn't keep growing its maps. Clear keeps the room, and WithPreWarm makes
+// more if it has more items than that
+func WithInitialCapacity(n int) Option {
+	return func(m *Cache) {
+		m.initialCapacity = n
+	}
+}
+
+// WithCacheNil(false) stops nil fetch results from being cached, so every Get
+// of a key whose fetch returned (nil, nil) fetches it again. Values that are
+// Set to nil are still cached. By default nil is cached like any other value
+func WithCacheNil(cacheNil bool) Option {
+	return func(m *Cache) {
+		m.skipNil = !cacheNil
+	}
+}
+
+// WithValueCopier makes every value handed out by Get and its variants,
+// GetOrSet and Snapshot a copy made by copier, typically a deep copy. Use it
+// when values are pointers, slices or maps that callers might mutate
+func WithValueCopier(copier func(interface{}) interface{}) Option {
+	return func(m *Cache) {
+		m.copier = copier
+	}
+}
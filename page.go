@@ -0,0 +1,89 @@
+package tcache
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// returns up to limit of the cached items that haven't expired, in sorted
+// key order starting right after afterKey. Start with SnapshotFirstPage, as
+// passing "" here skips an item cached under "". Pass nextKey as afterKey to
+// get the page after, done is true once there's none. Only a page's worth of
+// items is ever copied, so paging through a huge cache doesn't allocate the
+// whole of it like Snapshot does. Each page is consistent with the cache only
+// shard by shard, items stored or removed between pages may or may not show
+// up and an item whose key sorts before afterKey once paging has moved on is
+// missed. limit below 1 counts as 1
+func (m *Cache) SnapshotPage(afterKey string, limit int) (entries map[string]interface{}, nextKey string, done bool) {
+	return m.snapshotPage(afterKey, false, limit)
+}
+
+// like SnapshotPage, but returns the first page, the one starting with the
+// smallest key including ""
+func (m *Cache) SnapshotFirstPage(limit int) (entries map[string]interface{}, nextKey string, done bool) {
+	return m.snapshotPage("", true, limit)
+}
+
+// snapshotPage is SnapshotPage, starting with the smallest key instead of
+// the one after afterKey if first is set
+func (m *Cache) snapshotPage(afterKey string, first bool, limit int) (entries map[string]interface{}, nextKey string, done bool) {
+	if limit < 1 {
+		limit = 1
+	}
+	if m.shards == nil {
+		return nil, afterKey, true
+	}
+	// the limit+1 smallest keys after afterKey, the extra one only tells
+	// whether there's another page
+	page := &pageHeap{}
+	now := m.now()
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		for k, e := range s.items {
+			if !first && k <= afterKey || e.expired(now) {
+				continue
+			}
+			if page.Len() <= limit {
+				heap.Push(page, pageItem{k, e.value})
+			} else if k < (*page)[0].key {
+				(*page)[0] = pageItem{k, e.value}
+				heap.Fix(page, 0)
+			}
+		}
+		s.itemsLock.RUnlock()
+	}
+
+	items := *page
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+	done = len(items) <= limit
+	if !done {
+		items = items[:limit]
+	}
+	entries = make(map[string]interface{}, len(items))
+	nextKey = afterKey
+	for _, item := range items {
+		entries[item.key] = m.copyValue(item.value)
+		nextKey = item.key
+	}
+	return
+}
+
+type pageItem struct {
+	key   string
+	value interface{}
+}
+
+// pageHeap is a max-heap of items by key, so the biggest key of a page is
+// the one that gets replaced by a smaller one
+type pageHeap []pageItem
+
+func (h pageHeap) Len() int            { return len(h) }
+func (h pageHeap) Less(i, j int) bool  { return h[i].key > h[j].key }
+func (h pageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pageHeap) Push(x interface{}) { *h = append(*h, x.(pageItem)) }
+func (h *pageHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,59 @@
+package tcache
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotPage(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	got := map[string]interface{}{}
+	var pages [][]string
+	after := ""
+	for done := false; !done; {
+		var entries map[string]interface{}
+		entries, after, done = cache.SnapshotPage(after, 3)
+		var keys []string
+		for k, v := range entries {
+			got[k] = v
+			keys = append(keys, k)
+		}
+		pages = append(pages, keys)
+	}
+	if !reflect.DeepEqual(got, preWarmMap) {
+		t.Fatalf("values: %v, want %v", got, preWarmMap)
+	}
+	// 1 10 2, 3 4 5, 6 7 8, 9
+	if len(pages) != 4 || len(pages[3]) != 1 || after != "9" {
+		t.Fatalf("pages: %v, last key: %s, want 4 pages ending with 9", pages, after)
+	}
+
+	// an exact multiple of the limit ends on a full page
+	if entries, next, done := cache.SnapshotPage("8", 1); !done || next != "9" || len(entries) != 1 {
+		t.Fatalf("entries: %v, next: %s, done: %v, want only 9", entries, next, done)
+	}
+
+	// the first page includes the "" key, the pages after don't repeat it
+	empty, _ := New(getMd5Value)
+	empty.Set("", 0)
+	empty.Set("a", 1)
+	if entries, next, done := empty.SnapshotFirstPage(1); done || next != "" || !reflect.DeepEqual(entries, map[string]interface{}{"": 0}) {
+		t.Fatalf("entries: %v, next: %q, done: %v, want only \"\"", entries, next, done)
+	}
+	if entries, next, done := empty.SnapshotPage("", 1); !done || next != "a" || !reflect.DeepEqual(entries, map[string]interface{}{"a": 1}) {
+		t.Fatalf("entries: %v, next: %q, done: %v, want only a", entries, next, done)
+	}
+
+	// paging while the cache is written to, run with -race
+	wg := &sync.WaitGroup{}
+	slamMixed1To10ALot(t, cache, wg)
+	for after, done := "", false; !done; {
+		_, after, done = cache.SnapshotPage(after, 2)
+	}
+	wg.Wait()
+
+	if entries, _, done := (&Cache{}).SnapshotPage("", 10); entries != nil || !done {
+		t.Fatalf("entries: %v, done: %v, want nothing for an uninitialized cache", entries, done)
+	}
+}
@@ -0,0 +1,61 @@
+package tcache
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// writes a Snapshot of the cache to w with encoding/gob. Values are stored as
+// interface{}, so every concrete type in the cache has to be registered with
+// gob.Register before calling Save or Load
+func (m *Cache) Save(w io.Writer) (err error) {
+	items := m.Snapshot()
+	if items == nil {
+		err = ErrNotInitialized
+		return
+	}
+	return gob.NewEncoder(w).Encode(items)
+}
+
+// reads items written by Save from r and merges them into the cache, loaded
+// values overwrite cached ones for the same key and get the default ttl.
+// Nothing is stored if the input can't be decoded
+func (m *Cache) Load(r io.Reader) (err error) {
+	var items map[string]interface{}
+	if err = gob.NewDecoder(r).Decode(&items); err != nil {
+		return
+	}
+	return m.merge(items)
+}
+
+// encodes a Snapshot of the cache as a JSON object, null for an uninitialized
+// cache
+func (m *Cache) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Snapshot())
+}
+
+// merges a JSON object into the cache the same way Load does. JSON has no
+// type information, so values come back as whatever encoding/json decodes
+// into an interface{}: map[string]interface{}, []interface{}, float64,
+// string, bool or nil
+func (m *Cache) UnmarshalJSON(data []byte) (err error) {
+	var items map[string]interface{}
+	if err = json.Unmarshal(data, &items); err != nil {
+		return
+	}
+	return m.merge(items)
+}
+
+// merge stores every item as if it was Set, all at once
+func (m *Cache) merge(items map[string]interface{}) (err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	m.lockAll()
+	defer m.unlockAll()
+	for k, v := range items {
+		m.overrideFetch(k, m.shardFor(k).store(k, v))
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package tcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestSaveLoad(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	buf := &bytes.Buffer{}
+	if err := cache.Save(buf); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+
+	// loading merges into what's already cached
+	restored, _ := New(getMd5Value)
+	restored.Set("1", "one")
+	restored.Set("11", "eleven")
+	if err := restored.Load(buf); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	want := create1To10MD5Map()
+	want["11"] = "eleven"
+	if !reflect.DeepEqual(restored.Snapshot(), want) {
+		t.Fatalf("values: %v, want %v", restored.Snapshot(), want)
+	}
+
+	// custom types need to be registered
+	gob.Register(point{})
+	cache, _ = New(getMd5Value)
+	cache.Set("p", point{1, 2})
+	buf.Reset()
+	if err := cache.Save(buf); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	restored, _ = New(getMd5Value)
+	restored.Load(buf)
+	if value, _ := restored.Get("p"); value != (point{1, 2}) {
+		t.Fatalf("value: %v, want {1 2}", value)
+	}
+
+	// garbage doesn't touch the cache
+	if err := restored.Load(bytes.NewBufferString("garbage")); err == nil {
+		t.Fatal("should have returned an error")
+	}
+	if n := restored.Len(); n != 1 {
+		t.Fatalf("len: %d, want 1", n)
+	}
+
+	cache = &Cache{}
+	if err := cache.Save(buf); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	data, err := json.Marshal(cache)
+	if err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	restored, _ := New(getMd5Value)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if !reflect.DeepEqual(restored.Snapshot(), preWarmMap) {
+		t.Fatalf("values: %v, want %v", restored.Snapshot(), preWarmMap)
+	}
+
+	// numbers come back as float64
+	cache, _ = New(getMd5Value)
+	cache.Set("n", 1)
+	data, _ = json.Marshal(cache)
+	if string(data) != `{"n":1}` {
+		t.Fatalf("json: %s, want {\"n\":1}", data)
+	}
+	json.Unmarshal(data, restored)
+	if value, _ := restored.Get("n"); value != float64(1) {
+		t.Fatalf("value: %#v, want float64(1)", value)
+	}
+
+	data, _ = json.Marshal(&Cache{})
+	if string(data) != "null" {
+		t.Fatalf("json: %s, want null", data)
+	}
+	if err := json.Unmarshal([]byte(`{"n":1}`), &Cache{}); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
@@ -0,0 +1,55 @@
+package tcache
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket holding up to burst tokens, refilled at rate
+// tokens a second. Tokens can go negative, each waiter reserves the token it
+// will get and sleeps until then without holding the lock
+type limiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available. If that's further away than
+// maxWait, when maxWait is above 0, it returns false right away without
+// taking one
+func (l *limiter) wait(maxWait time.Duration) bool {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	var delay time.Duration
+	if l.tokens < 1 {
+		delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if maxWait > 0 && delay > maxWait {
+		l.lock.Unlock()
+		return false
+	}
+	l.tokens--
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+	return true
+}
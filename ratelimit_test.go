@@ -0,0 +1,42 @@
+package tcache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchRateLimit(t *testing.T) {
+	cache, _ := New(getMd5Value, WithFetchRateLimit(100, 5))
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func(i int) {
+			cache.Get(strconv.Itoa(i))
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	// the burst of 5 goes right away, the other 10 at 100 a second
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("elapsed: %v, want at least 100ms for 10 fetches past the burst", elapsed)
+	}
+	if cache.Len() != 15 {
+		t.Fatalf("len: %d, want 15", cache.Len())
+	}
+
+	// a wait longer than the fetch timeout gives up right away
+	cache, _ = New(getMd5Value, WithFetchRateLimit(1, 1), WithFetchTimeout(10*time.Millisecond))
+	cache.Get("1")
+	start = time.Now()
+	if _, err := cache.Get("2"); !errors.Is(err, ErrFetchTimeout) {
+		t.Fatalf("error: %v, want %v", err, ErrFetchTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("elapsed: %v, want no waiting", elapsed)
+	}
+}
@@ -0,0 +1,144 @@
+package tcache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// refreshes every cached key each interval until stop is called. Refreshes
+// share the single-flight with gets so they never stampede with them, and a
+// failing fetch keeps the old value. Keys that are deleted or cleared while
+// they're being refreshed stay gone. stop waits for a refresh that's running
+// to notice it and is safe to call more than once. Close stops it as well
+func (m *Cache) StartRefresh(interval time.Duration) (stop func()) {
+	return m.track(interval, func(done <-chan struct{}) {
+		clears := atomic.LoadUint64(&m.clears)
+		for _, key := range m.Keys() {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if atomic.LoadUint64(&m.clears) != clears {
+				// the rest of the keys were cleared, the next tick
+				// starts over with whatever is cached by then
+				return
+			}
+			if err := m.refreshCached(key, clears); err != nil {
+				m.log("refreshing "+key, err)
+			}
+		}
+	})
+}
+
+// refreshCached is Update for StartRefresh, but only if key is still cached
+// and isn't already being fetched, which refreshes it just the same. If key
+// is removed or the cache cleared while fetching, the fetched value is only
+// handed to the gets waiting on it, like for a forgotten fetch
+func (m *Cache) refreshCached(key string, clears uint64) (err error) {
+	if !m.cached(key) {
+		return
+	}
+	c, leader := m.claim(key)
+	if !leader {
+		return
+	}
+	defer m.release(key, c)
+	var value interface{}
+	c.run(func() {
+		value, err = m.callFetch(key, m.throughStore(m.transformed(m.currentFetch()), true))
+	})
+	skip := errors.Is(err, ErrSkipCache)
+	if err != nil && !skip {
+		c.err = err
+		return
+	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	if _, ok := s.items[key]; !ok || atomic.LoadUint64(&m.clears) != clears {
+		c.forgotten = true
+	}
+	m.storeFetchedLocked(s, key, c, value, skip)
+	return nil
+}
+
+// cached reports whether key is in the cache, expired or not
+func (m *Cache) cached(key string) bool {
+	s := m.shardFor(key)
+	s.itemsLock.RLock()
+	defer s.itemsLock.RUnlock()
+	_, ok := s.items[key]
+	return ok
+}
+
+// every calls tick each interval in its own goroutine until stop is called.
+// done is closed once stop is called so a long tick can bail out early. stop
+// waits for the goroutine to exit and is safe to call more than once
+func every(interval time.Duration, tick func(done <-chan struct{})) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			tick(done)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+		<-stopped
+	}
+}
+
+// debouncedUpdate is an update waiting out WithUpdateDebounce, shared by
+// every update of its key until it starts fetching
+type debouncedUpdate struct {
+	done chan struct{} // closed once e and err are set
+	e    entry
+	err  error
+}
+
+// update is Update and Refresh, debounced if the cache was created
+// WithUpdateDebounce
+func (m *Cache) update(key string) (e entry, err error) {
+	if m.updateDebounce <= 0 {
+		e, _, err = m.doFetch(key, true, m.currentFetch())
+		return
+	}
+
+	m.debounceLock.Lock()
+	d, waiting := m.debounced[key]
+	if !waiting {
+		if m.debounced == nil {
+			m.debounced = make(map[string]*debouncedUpdate)
+		}
+		d = &debouncedUpdate{done: make(chan struct{})}
+		m.debounced[key] = d
+	}
+	m.debounceLock.Unlock()
+	if waiting {
+		<-d.done
+		return d.e, d.err
+	}
+
+	time.Sleep(m.updateDebounce)
+	m.debounceLock.Lock()
+	delete(m.debounced, key)
+	m.debounceLock.Unlock()
+	d.e, _, d.err = m.doFetch(key, true, m.currentFetch())
+	close(d.done)
+	return d.e, d.err
+}
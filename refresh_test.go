@@ -0,0 +1,176 @@
+package tcache
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStartRefresh(t *testing.T) {
+	var version int64
+	cache, _ := New(func(key string) (interface{}, error) {
+		return atomic.LoadInt64(&version), nil
+	})
+	cache.Get("1")
+	cache.Get("2")
+
+	atomic.StoreInt64(&version, 1)
+	stop := cache.StartRefresh(time.Millisecond)
+	refreshed := func(want int64) bool {
+		for _, v := range cache.Snapshot() {
+			if v.(int64) != want {
+				return false
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(time.Second)
+	for !refreshed(1) {
+		if time.Now().After(deadline) {
+			t.Fatalf("values: %v, want every key refreshed", cache.Snapshot())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	stop()
+
+	// nothing is refreshed after stop
+	atomic.StoreInt64(&version, 2)
+	time.Sleep(10 * time.Millisecond)
+	if !refreshed(1) {
+		t.Fatalf("values: %v, want nothing refreshed after stop", cache.Snapshot())
+	}
+
+	// a failing refresh keeps the old value
+	cache.SetFetch(func(key string) (interface{}, error) {
+		return nil, errors.New("error")
+	})
+	stop = cache.StartRefresh(time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	if !refreshed(1) {
+		t.Fatalf("values: %v, want the old values kept", cache.Snapshot())
+	}
+}
+
+func TestStartRefreshClear(t *testing.T) {
+	var calls int64
+	started := make(chan string)
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		if atomic.AddInt64(&calls, 1) == 1 || key == "3" {
+			started <- key
+			<-release
+		}
+		return key, nil
+	})
+	cache.Set("1", "1")
+	cache.Set("2", "2")
+	stop := cache.StartRefresh(time.Millisecond)
+	defer stop()
+
+	// cleared while refreshing the first key, the other one isn't refreshed
+	// back into the cache
+	<-started
+	cache.Clear()
+	release <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if keys := cache.Keys(); len(keys) != 0 {
+		t.Fatalf("keys: %v, want none after Clear", keys)
+	}
+
+	// nor is a key deleted while it's being refreshed
+	cache.Set("3", "3")
+	<-started
+	cache.Delete("3")
+	release <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if keys := cache.Keys(); len(keys) != 0 {
+		t.Fatalf("keys: %v, want none after Delete", keys)
+	}
+
+	// even when it's deleted after the fetch, while the value is transformed
+	var transforms int64
+	transforming := make(chan struct{})
+	cache, _ = New(getMd5Value, WithTransform(func(key string, value interface{}) (interface{}, error) {
+		if atomic.AddInt64(&transforms, 1) == 1 {
+			transforming <- struct{}{}
+			<-release
+		}
+		return value, nil
+	}))
+	cache.Set("4", "4")
+	stop = cache.StartRefresh(time.Millisecond)
+	defer stop()
+	<-transforming
+	cache.Delete("4")
+	release <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if keys := cache.Keys(); len(keys) != 0 {
+		t.Fatalf("keys: %v, want none after Delete", keys)
+	}
+}
+
+func TestUpdateDebounce(t *testing.T) {
+	var version int64
+	cache, _ := New(func(key string) (interface{}, error) {
+		return atomic.AddInt64(&version, 1), nil
+	}, WithUpdateDebounce(20*time.Millisecond))
+	cache.Get("1")
+
+	values := make(chan interface{}, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			value, _ := cache.Refresh("1")
+			values <- value
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if value := <-values; value != int64(2) {
+			t.Fatalf("value: %v, want every update to share the fetch of 2", value)
+		}
+	}
+
+	// the next burst gets a fetch of its own
+	if err := cache.Update("1"); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if value, _ := cache.Get("1"); value != int64(3) {
+		t.Fatalf("value: %v, want 3", value)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	testErr := errors.New("error")
+	logged := make(chan error, 10)
+	var fail int32
+	cache, _ := New(func(key string) (interface{}, error) {
+		if atomic.LoadInt32(&fail) != 0 {
+			panic(testErr)
+		}
+		return key, nil
+	}, WithLogger(func(msg string, err error) {
+		select {
+		case logged <- err:
+		default:
+		}
+	}))
+	cache.Get("1")
+
+	// a background refresh panicking is logged once for the panic and once
+	// for the refresh failing
+	atomic.StoreInt32(&fail, 1)
+	stop := cache.StartRefresh(time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-logged:
+			if !errors.Is(err, ErrFetchPanicked) {
+				t.Fatalf("error: %v, want %v", err, ErrFetchPanicked)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the failed refresh should have been logged")
+		}
+	}
+	stop()
+}
@@ -0,0 +1,122 @@
+package tcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultShards is how many shards an unbounded cache is split into
+const defaultShards = 16
+
+// shard is an independently locked part of the cache's items. Keys are spread
+// over the shards by hash, so writes to different keys rarely share a lock
+type shard struct {
+	cache      *Cache
+	items      map[string]*entry
+	itemsLock  sync.RWMutex
+	lru        *list.List
+	freqs      *list.List // of *frequency, ascending, only used by PolicyLFU
+	maxEntries int        // this shard's part of the cache's maxEntries
+	maxBytes   int64      // this shard's part of the cache's maxBytes
+	bytes      int64      // estimated size of items, only tracked with maxBytes
+	pending    []event    // guarded by itemsLock, see unlock
+	capacity   int        // this shard's part of the cache's initialCapacity
+}
+
+// initShards splits the cache into shards. Bounded caches default to a single
+// shard so that the limits and the eviction order are exact, with more shards
+// every shard holds maxEntries/shards and maxBytes/shards rounded up and
+// evicts on its own
+func (m *Cache) initShards() {
+	n := m.shardCount
+	if n <= 0 {
+		n = defaultShards
+		if m.maxEntries > 0 || m.maxBytes > 0 {
+			n = 1
+		}
+	}
+	perShard := 0
+	if m.maxEntries > 0 {
+		perShard = (m.maxEntries + n - 1) / n
+	}
+	var bytesPerShard int64
+	if m.maxBytes > 0 {
+		bytesPerShard = (m.maxBytes + int64(n) - 1) / int64(n)
+		if m.sizer == nil {
+			m.sizer = sizeOf
+		}
+	}
+	m.shards = make([]*shard, n)
+	for i := range m.shards {
+		s := &shard{
+			cache:      m,
+			maxEntries: perShard,
+			maxBytes:   bytesPerShard,
+		}
+		s.capacity = m.perShard(m.initialCapacity)
+		s.items = s.newItems(0)
+		s.resetLRU()
+		m.shards[i] = s
+	}
+}
+
+// perShard is how many of n items end up in each shard, rounded up
+func (m *Cache) perShard(n int) int {
+	return (n + len(m.shards) - 1) / len(m.shards)
+}
+
+// newItems makes an items map with room for n items, or for the shard's
+// capacity if that's more
+func (s *shard) newItems(n int) map[string]*entry {
+	if n < s.capacity {
+		n = s.capacity
+	}
+	return make(map[string]*entry, n)
+}
+
+// shardFor returns the shard holding key, nil for an uninitialized cache
+func (m *Cache) shardFor(key string) *shard {
+	switch len(m.shards) {
+	case 0:
+		return nil
+	case 1:
+		return m.shards[0]
+	}
+	// inlined 32-bit FNV-1a so hashing doesn't allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return m.shards[h%uint32(len(m.shards))]
+}
+
+// lockAll write locks every shard, always in the same order
+func (m *Cache) lockAll() {
+	for _, s := range m.shards {
+		s.itemsLock.Lock()
+	}
+}
+
+// unlockAll releases every shard locked by lockAll, and only then runs the
+// callbacks for the events recorded in any of them, so the callbacks are
+// free to use the cache
+func (m *Cache) unlockAll() {
+	var events []event
+	for _, s := range m.shards {
+		events = append(events, s.pending...)
+		s.pending = nil
+		s.itemsLock.Unlock()
+	}
+	m.runCallbacks(events)
+}
+
+// reset drops every item of the shard, recording them as evicted, and makes
+// room for n new ones. Must be called with itemsLock held for writing
+func (s *shard) reset(n int) {
+	for k, e := range s.items {
+		s.record(event{key: k, value: e.value, meta: e.meta, evicted: true, reason: ReasonManual, cleared: true})
+	}
+	s.items = s.newItems(n)
+	s.resetLRU()
+}
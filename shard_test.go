@@ -0,0 +1,124 @@
+package tcache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	if n := len(cache.shards); n != defaultShards {
+		t.Fatalf("shards: %d, want %d", n, defaultShards)
+	}
+	for i := 0; i < 1000; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	for i, s := range cache.shards {
+		if len(s.items) == 0 {
+			t.Fatalf("shard %d is empty, keys should be spread over every shard", i)
+		}
+	}
+	if n := cache.Len(); n != 1000 {
+		t.Fatalf("len: %d, want 1000", n)
+	}
+	if n := len(cache.Snapshot()); n != 1000 {
+		t.Fatalf("snapshot len: %d, want 1000", n)
+	}
+	if n := len(cache.Keys()); n != 1000 {
+		t.Fatalf("keys len: %d, want 1000", n)
+	}
+	cache.Delete("1")
+	if cache.Has("1") || cache.Len() != 999 {
+		t.Fatal("1 should have been deleted")
+	}
+	cache.Clear()
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("len: %d, want 0", n)
+	}
+
+	// bounded caches default to a single shard
+	cache, _ = New(getMd5Value, WithMaxEntries(10))
+	if n := len(cache.shards); n != 1 {
+		t.Fatalf("shards: %d, want 1", n)
+	}
+
+	// unless told otherwise, then the limit is split between the shards
+	cache, _ = New(getMd5Value, WithMaxEntries(10), WithShards(4))
+	if n := len(cache.shards); n != 4 {
+		t.Fatalf("shards: %d, want 4", n)
+	}
+	for i := 0; i < 1000; i++ {
+		cache.Get(strconv.Itoa(i))
+	}
+	for i, s := range cache.shards {
+		if len(s.items) != 3 {
+			t.Fatalf("shard %d len: %d, want 3", i, len(s.items))
+		}
+	}
+}
+
+func TestShardsSlam(t *testing.T) {
+	// run with -race
+	cache, _ := New(getMd5Value, WithShards(4))
+	wg := &sync.WaitGroup{}
+	slam1To10ALot(cache, wg)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			cache.Set(key, computeMD5(key))
+			cache.Snapshot()
+			cache.Delete(key)
+			cache.Len()
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	for k, v := range cache.Snapshot() {
+		if !checkKey(k, v.(string)) {
+			t.Fatalf("key %s, value %v, want %s", k, v, computeMD5(k))
+		}
+	}
+}
+
+func BenchmarkSetDistinctKeys(b *testing.B) {
+	for _, shards := range []int{1, defaultShards} {
+		b.Run(strconv.Itoa(shards)+"Shards", func(b *testing.B) {
+			cache, _ := New(getMd5Value, WithShards(shards))
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					cache.Set(strconv.Itoa(i), i)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestInitialCapacity(t *testing.T) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	fill := func(opts ...Option) float64 {
+		return testing.AllocsPerRun(1, func() {
+			cache, _ := New(getMd5Value, opts...)
+			for _, key := range keys {
+				cache.Set(key, key)
+			}
+		})
+	}
+	// the maps never grow, which saves most allocations besides the
+	// entries themselves
+	if grown, presized := fill(), fill(WithInitialCapacity(len(keys))); presized >= grown {
+		t.Fatalf("allocs: %v presized, %v grown, want fewer presized", presized, grown)
+	}
+
+	cache, _ := New(getMd5Value, WithInitialCapacity(100), WithShards(4))
+	for _, s := range cache.shards {
+		if s.capacity != 25 {
+			t.Fatalf("shard capacity: %d, want 25", s.capacity)
+		}
+	}
+}
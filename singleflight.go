@@ -0,0 +1,487 @@
+package tcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// call is a fetch in flight for a single key. Every fetch gets its own call,
+// so a slow fetch only holds up the gets of its own key
+type call struct {
+	done chan struct{} // closed once the fetch is done
+
+	// set by Set and GetOrSet while the fetch is running so that their
+	// entry wins over the fetched one, guarded by the itemsLock of the
+	// key's shard
+	overwritten bool
+	set         entry
+
+	// set by Forget, the fetch's result is then only handed to the gets
+	// already waiting on it instead of being stored. Guarded by the
+	// itemsLock of the key's shard as well
+	forgotten bool
+
+	// whichever entry the fetch ended up with, set before done is closed
+	// and nil if the fetch failed, with err set instead. The waiting gets
+	// take them from here rather than from the shard, so they all get what
+	// the fetch got even if a Delete or Set lands as they wake up
+	result *entry
+	err    error
+}
+
+// doFetch is where Get, Update and Refresh all end up. It returns the cached
+// entry for key unless forceRefresh is set, otherwise it fetches key with
+// fetch and stores it. If a fetch for key is already in flight it waits for
+// that one instead, so however key is asked for there's only ever one fetch
+// for it at a time. Returns a copy of the resulting entry and where it came
+// from
+func (m *Cache) doFetch(key string, forceRefresh bool, fetch func(string) (interface{}, error)) (e entry, source Source, err error) {
+	return m.doFetchContext(context.Background(), key, forceRefresh, fetch)
+}
+
+// doFetchContext is doFetch giving up on waiting for another get's fetch
+// once ctx is done
+func (m *Cache) doFetchContext(ctx context.Context, key string, forceRefresh bool, fetch func(string) (interface{}, error)) (e entry, source Source, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	s := m.shardFor(key)
+	if !forceRefresh {
+		var ok bool
+		if e, ok = s.lookup(key); ok {
+			m.count(&m.stats.hits)
+			source = SourceHit
+			if e.stale(m.now()) {
+				m.refreshInBackground(key)
+			}
+			return
+		}
+		m.count(&m.stats.misses)
+		if e, ok = m.fromPreviousGeneration(key); ok {
+			source = SourceHit
+			return
+		}
+		if m.backoff != nil {
+			if err = m.backoff.check(key, m.now()); err != nil {
+				return
+			}
+		}
+	}
+
+	// only wrapped once it's clear key is fetched, so hits don't allocate
+	fetch = m.throughStore(m.transformed(fetch), forceRefresh)
+	if m.noSingleFlight {
+		source = SourceFetch
+		e, err = m.fetchAlone(s, key, fetch)
+		return
+	}
+	c, leader := m.claim(key)
+	if !leader { // prevent thundering herd
+		m.count(&m.stats.herdWaits)
+		source = SourceHerdWait
+		if m.reentrancyCheck && c.onStack() {
+			err = m.named(ErrReentrantFetch)
+			return
+		}
+		err = c.wait(ctx, m.maxHerdWait)
+		if err == ErrHerdTimeout && m.fetchOnHerdTimeout {
+			source = SourceFetch
+			e, err = m.fetchAlone(s, key, fetch)
+			return
+		}
+		if err != nil {
+			err = m.named(err)
+			return
+		}
+		// c.result and c.err are set before c.done is closed and never
+		// change after, so there's no need for the lock
+		if c.result != nil {
+			e = *c.result
+		}
+		err = c.err
+		return
+	}
+	defer m.release(key, c)
+	if !forceRefresh {
+		// a get that missed just before the previous fetch of key stored
+		// its value only gets to claim key after that fetch is done
+		if hit, ok := s.lookup(key); ok {
+			c.result = &hit
+			return hit, SourceHit, nil
+		}
+	}
+	source = SourceFetch
+
+	var value interface{}
+	c.run(func() {
+		value, err = m.callFetch(key, fetch)
+	})
+	skip := errors.Is(err, ErrSkipCache)
+	if err != nil && !skip {
+		c.err = err
+		return
+	}
+	err = nil
+	e = m.storeFetched(key, c, value, skip)
+	return
+}
+
+// fetchInBackground fetches and stores key for the background refreshes,
+// sharing the single-flight with gets like any other fetch. Nothing is
+// fetched if key is already being fetched, or if it's cached and current
+// reports the cached entry is good as it is. ok reports whether key ended up
+// cached by this or an earlier fetch
+func (m *Cache) fetchInBackground(key string, current func(e entry) bool) (ok bool, err error) {
+	c, leader := m.claim(key)
+	if !leader {
+		return
+	}
+	defer m.release(key, c)
+	if e, cached := m.shardFor(key).lookup(key); cached && current(e) {
+		// the gets waiting on c get that
+		c.result = &e
+		return true, nil
+	}
+	var value interface{}
+	c.run(func() {
+		value, err = m.callFetch(key, m.throughStore(m.transformed(m.currentFetch()), true))
+	})
+	skip := errors.Is(err, ErrSkipCache)
+	if err != nil && !skip {
+		c.err = err
+		return
+	}
+	m.storeFetched(key, c, value, skip)
+	return !skip, nil
+}
+
+// claim marks key as being fetched by the caller. If another fetch for key is
+// already in flight it returns that fetch's call and leader is false
+func (m *Cache) claim(key string) (c *call, leader bool) {
+	if inflight, ok := m.calls.Load(key); ok {
+		return inflight.(*call), false
+	}
+	c = &call{done: make(chan struct{})}
+	if inflight, loaded := m.calls.LoadOrStore(key, c); loaded {
+		return inflight.(*call), false
+	}
+	return c, true
+}
+
+// wait blocks until the fetch made by c is done, or gives up with
+// ErrHerdTimeout after maxWait if that's above 0, or with ctx's error once
+// it's done
+func (c *call) wait(ctx context.Context, maxWait time.Duration) error {
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-timeout:
+		return ErrHerdTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run calls fetch as c's leader. This frame, with c as its receiver, is what
+// onStack looks for with WithReentrancyCheck, so claiming a key stays cheap
+// and only waiting on it pays for telling a fetch waiting on itself apart
+//
+//go:noinline
+func (c *call) run(fetch func()) {
+	fetch()
+	runtime.KeepAlive(c) // c has to stay in the frame for the stack trace
+}
+
+// onStack reports whether the current goroutine is inside c.run, ie. whether
+// it's the one fetching for c. Only the stack trace tells which call a run
+// frame is for, so it's only formatted when there's a run frame at all
+func (c *call) onStack() bool {
+	if !inRun() {
+		return false
+	}
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) || len(buf) >= maxStackScan {
+			return bytes.Contains(buf[:n], []byte(fmt.Sprintf("(*call).run(%p", c)))
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// inRun reports whether the current goroutine is inside any call.run
+func inRun() bool {
+	pcs := make([]uintptr, 64)
+	for skip := 2; ; skip += len(pcs) {
+		n := runtime.Callers(skip, pcs)
+		for _, pc := range pcs[:n] {
+			if fn := runtime.FuncForPC(pc - 1); fn != nil && strings.HasSuffix(fn.Name(), ".(*call).run") {
+				return true
+			}
+		}
+		if n < len(pcs) {
+			return false
+		}
+	}
+}
+
+// maxStackScan bounds how much of a goroutine's stack trace onStack reads
+const maxStackScan = 1 << 20
+
+// release hands key back after a claim, waking up everyone waiting on it
+func (m *Cache) release(key string, c *call) {
+	m.calls.CompareAndDelete(key, c)
+	close(c.done)
+}
+
+// callFetch runs fetch for a claimed key, retrying it if the cache was
+// created with WithRetry. Every attempt waits on the rate limit, if there is
+// one. The outcome is recorded for WithErrorBackoff
+func (m *Cache) callFetch(key string, fetch func(string) (interface{}, error)) (value interface{}, err error) {
+	if m.backoff != nil {
+		defer func() {
+			m.backoff.record(key, err, m.now())
+		}()
+	}
+	if m.fetchSem != nil {
+		m.gauge(&m.stats.queued, 1)
+		m.fetchSem <- struct{}{}
+		m.gauge(&m.stats.queued, -1)
+		defer func() {
+			<-m.fetchSem
+		}()
+	}
+	m.gauge(&m.stats.inFlight, 1)
+	defer m.gauge(&m.stats.inFlight, -1)
+
+	for attempt := 1; ; attempt++ {
+		if m.limiter != nil && !m.limiter.wait(m.fetchTimeout) {
+			err = m.named(ErrFetchTimeout)
+			return
+		}
+		value, err = m.fetchOnce(key, fetch)
+		if err == nil || errors.Is(err, ErrSkipCache) || attempt >= m.retryAttempts {
+			return
+		}
+		time.Sleep(m.retryBackoff << uint(attempt-1))
+	}
+}
+
+// fetchOnce makes a single fetch, giving up on it with ErrFetchTimeout if it
+// takes longer than fetchTimeout. A timed out fetch is left to finish in the
+// background and its result is dropped. No locks are held while it runs, so
+// the fetch observer is called from here too
+func (m *Cache) fetchOnce(key string, fetch func(string) (interface{}, error)) (value interface{}, err error) {
+	m.count(&m.stats.fetches)
+	var start time.Time
+	if m.statsEnabled || m.fetchObserver != nil {
+		start = time.Now()
+	}
+	defer func() {
+		if m.statsEnabled || m.fetchObserver != nil {
+			d := time.Since(start)
+			m.observeFetch(d)
+			if m.fetchObserver != nil {
+				m.fetchObserver(key, d, err)
+			}
+		}
+		if err != nil && !errors.Is(err, ErrSkipCache) {
+			m.count(&m.stats.fetchErrors)
+		}
+	}()
+	if m.fetchTimeout <= 0 {
+		return m.safeFetch(key, fetch)
+	}
+
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := m.safeFetch(key, fetch)
+		done <- result{value, err}
+	}()
+	timer := time.NewTimer(m.fetchTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		return nil, m.named(ErrFetchTimeout)
+	}
+}
+
+// fetchConditionally is the fetch of caches created WithConditionalFetch
+func (m *Cache) fetchConditionally(key string) (value interface{}, err error) {
+	var current interface{}
+	s := m.shardFor(key)
+	s.itemsLock.RLock()
+	if e, ok := s.items[key]; ok {
+		current = e.value
+	}
+	s.itemsLock.RUnlock()
+
+	value, unchanged, err := m.conditionalFetch(key, current)
+	if err == nil && unchanged {
+		value = current
+	}
+	return
+}
+
+// transformed wraps fetch so its values go through the transform from
+// WithTransform, if there is one
+func (m *Cache) transformed(fetch func(string) (interface{}, error)) func(string) (interface{}, error) {
+	if m.transform == nil {
+		return fetch
+	}
+	return func(key string) (value interface{}, err error) {
+		if value, err = fetch(key); err != nil {
+			return
+		}
+		return m.transform(key, value)
+	}
+}
+
+// fetchMulti is the fetch of caches created WithMultiFetch, storing the extra
+// items right away unless the cache was cleared in the meantime
+func (m *Cache) fetchMulti(key string) (value interface{}, err error) {
+	clears := atomic.LoadUint64(&m.clears)
+	value, extra, err := m.multiFetch(key)
+	if err != nil {
+		return
+	}
+	for k, v := range extra {
+		if k == key || v == nil && m.skipNil {
+			continue
+		}
+		s := m.shardFor(k)
+		s.itemsLock.Lock()
+		if atomic.LoadUint64(&m.clears) == clears {
+			m.overrideFetch(k, s.store(k, v))
+		}
+		s.unlock()
+	}
+	return
+}
+
+// safeFetch calls fetch, turning a panic into an ErrFetchPanicked error so
+// the caller still releases the key. Errors returned by fetch are wrapped in
+// a FetchError
+func (m *Cache) safeFetch(key string, fetch func(string) (interface{}, error)) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value = nil
+			err = m.named(fmt.Errorf("%w: %v", ErrFetchPanicked, r))
+			m.log("fetching "+key, err)
+		}
+	}()
+	if value, err = fetch(key); err != nil {
+		err = &FetchError{Key: key, Err: err}
+	}
+	return
+}
+
+// overrideFetch makes the just stored e win over the result of a fetch for
+// key that is currently in flight. Must be called with the itemsLock of key's
+// shard held
+func (m *Cache) overrideFetch(key string, e *entry) {
+	if inflight, ok := m.calls.Load(key); ok {
+		c := inflight.(*call)
+		c.overwritten = true
+		c.set = *e
+	}
+}
+
+// drops the fetch for key that's in flight, if there is one, so the next Get
+// fetches key again instead of waiting on it, like singleflight's Forget.
+// Gets already waiting on the forgotten fetch still get its result once it's
+// done, but it isn't cached
+func (m *Cache) Forget(key string) {
+	s := m.shardFor(key)
+	if s == nil {
+		return
+	}
+	s.itemsLock.Lock()
+	defer s.itemsLock.Unlock()
+	if inflight, ok := m.calls.LoadAndDelete(key); ok {
+		inflight.(*call).forgotten = true
+	}
+}
+
+// fetchAlone fetches and stores key next to the fetch in flight for it, for
+// gets that gave up waiting on that one and for every get
+// WithSingleFlight(false). Like a forgotten fetch, its result isn't stored if
+// the cache was cleared in the meantime
+func (m *Cache) fetchAlone(s *shard, key string, fetch func(string) (interface{}, error)) (e entry, err error) {
+	clears := atomic.LoadUint64(&m.clears)
+	value, err := m.callFetch(key, fetch)
+	if errors.Is(err, ErrSkipCache) {
+		e.value, err = value, nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if value == nil && m.skipNil {
+		return
+	}
+	s.itemsLock.Lock()
+	defer s.unlock()
+	if atomic.LoadUint64(&m.clears) != clears {
+		// cleared while fetching, like a forgotten fetch
+		e.value = value
+		return
+	}
+	e = *s.store(key, value)
+	return
+}
+
+// forgetAll forgets every fetch in flight. Must be called with every shard
+// locked
+func (m *Cache) forgetAll() {
+	m.calls.Range(func(key, inflight interface{}) bool {
+		m.calls.Delete(key)
+		inflight.(*call).forgotten = true
+		return true
+	})
+}
+
+// storeFetched stores the result of a claimed fetch unless key was Set while
+// the fetch was running, returning a copy of whichever entry ended up in the
+// cache and keeping it for the gets waiting on c. A nil result isn't stored
+// with WithCacheNil(false), nor is the result of a forgotten fetch or one
+// that returned ErrSkipCache, which sets skip
+func (m *Cache) storeFetched(key string, c *call, value interface{}, skip bool) entry {
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	return m.storeFetchedLocked(s, key, c, value, skip)
+}
+
+// storeFetchedLocked is storeFetched for callers that already hold the
+// itemsLock of key's shard s for writing
+func (m *Cache) storeFetchedLocked(s *shard, key string, c *call, value interface{}, skip bool) entry {
+	switch {
+	case c.overwritten:
+		c.result = &c.set
+	case c.forgotten, skip, value == nil && m.skipNil:
+		c.result = &entry{value: value}
+	default:
+		stored := *s.store(key, value)
+		c.result = &stored
+	}
+	return *c.result
+}
@@ -0,0 +1,651 @@
+package tcache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchPanic(t *testing.T) {
+	panicked := false
+	cache, _ := New(func(key string) (interface{}, error) {
+		if !panicked {
+			panicked = true
+			panic("boom")
+		}
+		return computeMD5(key), nil
+	}, WithStats())
+	value, err := cache.Get("1")
+	if !errors.Is(err, ErrFetchPanicked) {
+		t.Fatalf("error: %v, want %v", err, ErrFetchPanicked)
+	}
+	if value != nil {
+		t.Fatalf("value: %v, want nil", value)
+	}
+	if stats := cache.Stats(); stats.FetchErrors != 1 {
+		t.Fatalf("fetch errors: %d, want 1", stats.FetchErrors)
+	}
+
+	// the key was released so it can be fetched again
+	value, err = cache.Get("1")
+	if err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, want %s", value, computeMD5("1"))
+	}
+	wg := &sync.WaitGroup{}
+	slam1To10ALot(cache, wg)
+	wg.Wait()
+
+	// Update recovers too
+	cache.SetFetch(func(key string) (interface{}, error) {
+		panic("boom")
+	})
+	if err := cache.Update("1"); !errors.Is(err, ErrFetchPanicked) {
+		t.Fatalf("error: %v, want %v", err, ErrFetchPanicked)
+	}
+	if err := cache.Update("1"); !errors.Is(err, ErrFetchPanicked) {
+		t.Fatalf("error: %v, want %v", err, ErrFetchPanicked)
+	}
+}
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	cache, _ := New(func(key string) (interface{}, error) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return computeMD5(key), nil
+	}, WithMaxConcurrentFetches(3))
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			value, err := cache.Get(key)
+			if err != nil || !checkKey(key, value.(string)) {
+				t.Errorf("key %s, value %v, error %v", key, value, err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	if maxRunning != 3 {
+		t.Fatalf("concurrent fetches: %d, want 3", maxRunning)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	var slow int32 = 1
+	cache, _ := New(func(key string) (interface{}, error) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(time.Second)
+		}
+		return computeMD5(key), nil
+	}, WithFetchTimeout(10*time.Millisecond))
+
+	start := time.Now()
+	if _, err := cache.Get("1"); err != ErrFetchTimeout {
+		t.Fatalf("error: %v, want %v", err, ErrFetchTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("took %v, should have given up after 10ms", elapsed)
+	}
+
+	// the key was released, the next get tries again
+	atomic.StoreInt32(&slow, 0)
+	if value, err := cache.Get("1"); err != nil || !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, error: %v, want %s, nil", value, err, computeMD5("1"))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var calls int
+	testErr := errors.New("error")
+	cache, _ := New(func(key string) (interface{}, error) {
+		calls++
+		if calls < 3 {
+			return nil, testErr
+		}
+		return computeMD5(key), nil
+	}, WithRetry(3, time.Millisecond), WithStats())
+	if value, err := cache.Get("1"); err != nil || !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, error: %v, want %s, nil", value, err, computeMD5("1"))
+	}
+	if stats := cache.Stats(); stats.Fetches != 3 || stats.FetchErrors != 2 {
+		t.Fatalf("stats: %+v, want 3 fetches and 2 errors", stats)
+	}
+
+	// the last error is returned once every attempt failed
+	calls = -10
+	start := time.Now()
+	if err := cache.Update("1"); !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+	if calls != -7 {
+		t.Fatalf("calls: %d, want 3 more attempts", calls+10)
+	}
+	// backs off 1ms then 2ms
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Fatalf("took %v, want at least 3ms of backoff", elapsed)
+	}
+}
+
+func TestReentrantFetch(t *testing.T) {
+	var cache *Cache
+	var innerErr error
+	cache, _ = New(func(key string) (interface{}, error) {
+		switch key {
+		case "a":
+			// directly
+			_, innerErr = cache.Get("a")
+		case "b":
+			// transitively, through c
+			return cache.Get("c")
+		case "c":
+			return cache.Get("b")
+		case "d":
+			innerErr = cache.Update("d")
+		}
+		return computeMD5(key), nil
+	}, WithReentrancyCheck())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if value, err := cache.Get("a"); err != nil || !checkKey("a", value.(string)) {
+			t.Errorf("value: %v, error: %v, want %s, nil", value, err, computeMD5("a"))
+		}
+		if innerErr != ErrReentrantFetch {
+			t.Errorf("error: %v, want %v", innerErr, ErrReentrantFetch)
+		}
+		if _, err := cache.Get("b"); !errors.Is(err, ErrReentrantFetch) {
+			t.Errorf("error: %v, want %v", err, ErrReentrantFetch)
+		}
+		innerErr = nil
+		cache.Get("d")
+		if innerErr != ErrReentrantFetch {
+			t.Errorf("error: %v, want %v", innerErr, ErrReentrantFetch)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlocked")
+	}
+
+	// b and c were released, so trying again fails the same way instead of
+	// hanging on a stale claim
+	if _, err := cache.Get("b"); !errors.Is(err, ErrReentrantFetch) {
+		t.Fatalf("error: %v, want %v", err, ErrReentrantFetch)
+	}
+
+	// without the check it just waits on itself
+	cache, _ = New(func(key string) (interface{}, error) {
+		_, innerErr = cache.Get(key)
+		return key, nil
+	}, WithMaxHerdWait(10*time.Millisecond, false))
+	cache.Get("a")
+	if innerErr != ErrHerdTimeout {
+		t.Fatalf("error: %v, want %v", innerErr, ErrHerdTimeout)
+	}
+}
+
+func TestCallOnStack(t *testing.T) {
+	a, b := &call{}, &call{}
+	a.run(func() {
+		b.run(func() {
+			if !a.onStack() || !b.onStack() {
+				t.Error("onStack: false, want true inside run")
+			}
+		})
+		done := make(chan bool)
+		go func() {
+			done <- a.onStack()
+		}()
+		if <-done {
+			t.Error("onStack: true, want false on another goroutine")
+		}
+	})
+	if a.onStack() {
+		t.Error("onStack: true, want false after run")
+	}
+}
+
+func TestGetWithSource(t *testing.T) {
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		<-release
+		return computeMD5(key), nil
+	}, WithStats())
+
+	fetched := make(chan Source)
+	go func() {
+		_, source, _ := cache.GetWithSource("1")
+		fetched <- source
+	}()
+	for cache.Stats().Fetches != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	waited := make(chan Source)
+	go func() {
+		_, source, _ := cache.GetWithSource("1")
+		waited <- source
+	}()
+	for cache.Stats().HerdWaits != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if source := <-fetched; source != SourceFetch {
+		t.Fatalf("source: %v, want %v", source, SourceFetch)
+	}
+	if source := <-waited; source != SourceHerdWait {
+		t.Fatalf("source: %v, want %v", source, SourceHerdWait)
+	}
+
+	value, source, err := cache.GetWithSource("1")
+	if err != nil || source != SourceHit || !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, source: %v, error: %v, want a hit", value, source, err)
+	}
+}
+
+func TestForget(t *testing.T) {
+	var calls int64
+	wedged := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-wedged
+			return "bad", nil
+		}
+		return "good", nil
+	}, WithStats())
+
+	results := make(chan interface{}, 2)
+	go func() {
+		value, _ := cache.Get("1")
+		results <- value
+	}()
+	for atomic.LoadInt64(&calls) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		value, _ := cache.Get("1")
+		results <- value
+	}()
+	for cache.Stats().HerdWaits != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the next get starts fresh instead of waiting on the wedged fetch
+	cache.Forget("1")
+	if value, err := cache.Get("1"); err != nil || value != "good" {
+		t.Fatalf("value: %v, error: %v, want good", value, err)
+	}
+
+	// the forgotten fetch finishing releases its waiters without being cached
+	close(wedged)
+	for i := 0; i < 2; i++ {
+		if value := <-results; value != "bad" {
+			t.Fatalf("value: %v, want the forgotten fetch's result", value)
+		}
+	}
+	if value, _ := cache.Get("1"); value != "good" {
+		t.Fatalf("value: %v, want good", value)
+	}
+
+	cache.Forget("2")
+	cache = &Cache{}
+	cache.Forget("1")
+}
+
+func TestMaxHerdWait(t *testing.T) {
+	// the first fetch of every cache hangs until released
+	newCache := func(fetchOnTimeout bool) (cache *Cache, release chan struct{}) {
+		var calls int64
+		started := make(chan struct{})
+		release = make(chan struct{})
+		cache, _ = New(func(key string) (interface{}, error) {
+			if atomic.AddInt64(&calls, 1) == 1 {
+				close(started)
+				<-release
+				return "slow", nil
+			}
+			return "fast", nil
+		}, WithMaxHerdWait(5*time.Millisecond, fetchOnTimeout))
+		go cache.Get("1")
+		<-started
+		return
+	}
+
+	cache, release := newCache(false)
+	if _, err := cache.Get("1"); err != ErrHerdTimeout {
+		t.Fatalf("error: %v, want %v", err, ErrHerdTimeout)
+	}
+	close(release)
+
+	// falling through to a fetch of its own
+	cache, release = newCache(true)
+	value, source, err := cache.GetWithSource("1")
+	if err != nil || value != "fast" || source != SourceFetch {
+		t.Fatalf("value: %v, source: %v, error: %v, want its own fetch", value, source, err)
+	}
+	close(release)
+}
+
+func TestGetContext(t *testing.T) {
+	var calls int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return computeMD5(key), nil
+	}, WithStats())
+
+	// a Get and a GetContext of the same cold key share its fetch
+	got := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("1")
+		got <- value
+	}()
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		value, _ := cache.GetContext(ctx, "1")
+		got <- value
+	}()
+	for cache.Stats().HerdWaits != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// while a canceled one stops waiting
+	canceled, cancelWait := context.WithCancel(context.Background())
+	waited := make(chan error)
+	go func() {
+		_, err := cache.GetContext(canceled, "1")
+		waited <- err
+	}()
+	for cache.Stats().HerdWaits != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancelWait()
+	if err := <-waited; !errors.Is(err, context.Canceled) {
+		t.Fatalf("error: %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if value := <-got; !checkKey("1", value.(string)) {
+			t.Fatalf("value: %v, want the md5 of 1", value)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("calls: %d, want 1", calls)
+	}
+	if _, err := cache.GetContext(canceled, "2"); err != context.Canceled {
+		t.Fatalf("error: %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNoSingleFlight(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		<-release
+		return computeMD5(key), nil
+	}, WithSingleFlight(false), WithStats())
+
+	// concurrent gets of a cold key each fetch it
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := cache.Get("1"); err != nil || !checkKey("1", value.(string)) {
+				t.Errorf("value: %v, error: %v, want the md5 of 1", value, err)
+			}
+		}()
+	}
+	for atomic.LoadInt64(&calls) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if stats := cache.Stats(); stats.HerdWaits != 0 || stats.Fetches != 3 {
+		t.Fatalf("stats: %+v, want 3 fetches and no herd waits", stats)
+	}
+	if value, _ := cache.Get("1"); !checkKey("1", value.(string)) || calls != 3 {
+		t.Fatalf("value: %v, calls: %d, want a hit", value, calls)
+	}
+}
+
+func TestFetchObserver(t *testing.T) {
+	testErr := errors.New("error")
+	type observed struct {
+		key string
+		err error
+	}
+	var lock sync.Mutex
+	var got []observed
+	var cache *Cache
+	cache, _ = New(func(key string) (interface{}, error) {
+		if key == "bad" {
+			return nil, testErr
+		}
+		return key, nil
+	}, WithFetchObserver(func(key string, d time.Duration, err error) {
+		cache.Set("observer", key) // no locks are held
+		lock.Lock()
+		got = append(got, observed{key, err})
+		lock.Unlock()
+	}))
+	cache.Get("1")
+	cache.Get("1")
+	cache.Update("1")
+	cache.Refresh("2")
+	cache.Get("bad")
+	want := []observed{{"1", nil}, {"1", nil}, {"2", nil}, {"bad", &FetchError{"bad", testErr}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("observed: %v, want %v", got, want)
+	}
+}
+
+func TestConditionalFetch(t *testing.T) {
+	var version int64 = 1
+	var currents []interface{}
+	now := time.Now()
+	cache, _ := New(nil, WithTTL(time.Minute), WithConditionalFetch(func(key string, current interface{}) (interface{}, bool, error) {
+		currents = append(currents, current)
+		if current == version {
+			return nil, true, nil
+		}
+		return version, false, nil
+	}))
+	cache.now = func() time.Time { return now }
+
+	cache.Get("1")
+	now = now.Add(30 * time.Second)
+	if value, _ := cache.Refresh("1"); value != int64(1) {
+		t.Fatalf("value: %v, want the unchanged 1", value)
+	}
+	if _, expiresAt, _ := cache.GetWithExpiry("1"); !expiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expires at: %v, want a fresh ttl", expiresAt)
+	}
+
+	// the current value is passed even once it has expired
+	version = 2
+	now = now.Add(2 * time.Minute)
+	if value, _ := cache.Get("1"); value != int64(2) {
+		t.Fatalf("value: %v, want 2", value)
+	}
+	want := []interface{}{nil, int64(1), int64(1)}
+	if !reflect.DeepEqual(currents, want) {
+		t.Fatalf("current values: %v, want %v", currents, want)
+	}
+}
+
+func TestMultiFetch(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	cache, _ := New(nil, WithMultiFetch(func(key string) (interface{}, map[string]interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		if key == "b" {
+			<-release
+			return "b alone", nil, nil
+		}
+		return key, map[string]interface{}{"b": "b from " + key, "c": "c from " + key}, nil
+	}))
+
+	// b is already being fetched when a's fetch brings it along
+	got := make(chan interface{})
+	go func() {
+		value, _ := cache.Get("b")
+		got <- value
+	}()
+	for atomic.LoadInt64(&calls) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if value, err := cache.Get("a"); err != nil || value != "a" {
+		t.Fatalf("value: %v, error: %v, want a", value, err)
+	}
+	close(release)
+	if value := <-got; value != "b from a" {
+		t.Fatalf("value: %v, want b from a", value)
+	}
+	if value, _ := cache.Get("c"); value != "c from a" || calls != 2 {
+		t.Fatalf("value: %v, calls: %d, want c from a without a fetch", value, calls)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	testErr := errors.New("error")
+	store := NewMemoryStore()
+	cache, _ := New(func(key string) (interface{}, error) {
+		return " " + key + " ", nil
+	}, WithBackingStore(store), WithTransform(func(key string, value interface{}) (interface{}, error) {
+		if key == "bad" {
+			return nil, testErr
+		}
+		return strings.TrimSpace(value.(string)), nil
+	}))
+	if value, err := cache.Get("1"); err != nil || value != "1" {
+		t.Fatalf("value: %q, error: %v, want 1", value, err)
+	}
+	if value, _, _ := store.Get("1"); value != "1" {
+		t.Fatalf("stored: %q, want the transformed 1", value)
+	}
+	if _, err := cache.Get("bad"); !errors.Is(err, testErr) || cache.Has("bad") {
+		t.Fatalf("error: %v, want %v and nothing cached", err, testErr)
+	}
+	cache.Set("2", " 2 ")
+	if value, _ := cache.Get("2"); value != " 2 " {
+		t.Fatalf("value: %q, want Set values left alone", value)
+	}
+}
+
+func TestFetchErrorRetried(t *testing.T) {
+	var calls int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+	testErr := errors.New("error")
+	cache, _ := New(func(key string) (interface{}, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			close(started)
+			<-release
+			return nil, testErr
+		}
+		return computeMD5(key), nil
+	}, WithStats())
+
+	// every get waiting on the failed fetch gets its error
+	errs := make(chan error)
+	go func() {
+		_, err := cache.Get("1")
+		errs <- err
+	}()
+	<-started
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := cache.Get("1")
+			errs <- err
+		}()
+	}
+	for cache.Stats().HerdWaits != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; !errors.Is(err, testErr) {
+			t.Fatalf("error: %v, want %v", err, testErr)
+		}
+	}
+
+	// and nothing is left over to stop the next get from fetching again
+	if value, err := cache.Get("1"); err != nil || !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, error: %v, want %s, nil", value, err, computeMD5("1"))
+	}
+	if calls != 2 {
+		t.Fatalf("calls: %d, want 2", calls)
+	}
+}
+
+func TestOneFetchPerColdKey(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	fetches := make(map[string]int)
+	cache, _ := New(func(key string) (interface{}, error) {
+		<-release
+		return computeMD5(key), nil
+	}, WithStats(), WithFetchObserver(func(key string, d time.Duration, err error) {
+		lock.Lock()
+		fetches[key]++
+		lock.Unlock()
+	}))
+
+	// 10k gets of 10 cold keys, the fetches held up until every other get
+	// waits on them
+	var wg sync.WaitGroup
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(i % 10)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := cache.Get(key); err != nil || !checkKey(key, value.(string)) {
+				t.Errorf("value: %v, error: %v, want %s, nil", value, err, computeMD5(key))
+			}
+		}()
+	}
+	for cache.Stats().HerdWaits != 10000-10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if len(fetches) != 10 {
+		t.Fatalf("fetched %d keys, want 10", len(fetches))
+	}
+	for key, n := range fetches {
+		if n != 1 {
+			t.Errorf("%s was fetched %d times, want once", key, n)
+		}
+	}
+}
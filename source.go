@@ -0,0 +1,32 @@
+package tcache
+
+// Source is where the value returned by GetWithSource came from
+type Source int
+
+const (
+	// SourceHit is a value that was already cached
+	SourceHit Source = iota
+	// SourceFetch is a value this get fetched itself
+	SourceFetch
+	// SourceHerdWait is a value fetched by another get of the same key that
+	// this one waited on
+	SourceHerdWait
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceHit:
+		return "hit"
+	case SourceFetch:
+		return "fetch"
+	case SourceHerdWait:
+		return "herd wait"
+	}
+	return "unknown"
+}
+
+// like Get, but also tells where the value came from, eg. to annotate traces
+func (m *Cache) GetWithSource(key string) (value interface{}, source Source, err error) {
+	e, source, err := m.doFetch(key, false, m.currentFetch())
+	return m.copyValue(e.value), source, err
+}
@@ -0,0 +1,135 @@
+package tcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// FetchDurationBuckets are the upper bounds of the fetch duration histogram
+// in Stats.FetchDurationCounts
+var FetchDurationBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Stats is a point in time copy of the cache counters
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Fetches     uint64
+	FetchErrors uint64
+	HerdWaits   uint64
+	Evictions   uint64 // items dropped by the lru or because they expired
+	Bytes       int64  // estimated size of the cached items, see WithMaxBytes
+	InFlight    int64  // fetches running right now
+	Queued      int64  // fetches waiting on WithMaxConcurrentFetches for a slot
+
+	EventsDropped uint64 // events a subscriber missed, see Subscribe
+
+	// total time spent fetching, and how many fetches took at most
+	// FetchDurationBuckets[i] but longer than the bucket before it. Fetches
+	// slower than the last bucket are only counted in Fetches
+	FetchDuration       time.Duration
+	FetchDurationCounts [len(FetchDurationBuckets)]uint64
+}
+
+// counters are updated with sync/atomic so that recording them never
+// contends on the cache locks. Keep it as the first field of Cache so the
+// uint64s stay 64-bit aligned on 32-bit platforms.
+type counters struct {
+	hits        uint64
+	misses      uint64
+	fetches     uint64
+	fetchErrors uint64
+	herdWaits   uint64
+	evictions   uint64
+
+	eventsDropped uint64 // by Subscribe
+
+	fetchNanos          uint64
+	fetchDurationCounts [len(FetchDurationBuckets)]uint64
+
+	// gauges going up and down
+	inFlight int64
+	queued   int64
+}
+
+// Stats returns the current hit/miss/fetch counts. They're only recorded for
+// caches created with WithStats, Bytes is reported whenever WithMaxBytes is
+// used
+func (m *Cache) Stats() (stats Stats) {
+	stats = Stats{
+		Hits:          atomic.LoadUint64(&m.stats.hits),
+		Misses:        atomic.LoadUint64(&m.stats.misses),
+		Fetches:       atomic.LoadUint64(&m.stats.fetches),
+		FetchErrors:   atomic.LoadUint64(&m.stats.fetchErrors),
+		HerdWaits:     atomic.LoadUint64(&m.stats.herdWaits),
+		Evictions:     atomic.LoadUint64(&m.stats.evictions),
+		FetchDuration: time.Duration(atomic.LoadUint64(&m.stats.fetchNanos)),
+		InFlight:      atomic.LoadInt64(&m.stats.inFlight),
+		Queued:        atomic.LoadInt64(&m.stats.queued),
+		EventsDropped: atomic.LoadUint64(&m.stats.eventsDropped),
+	}
+	for i := range stats.FetchDurationCounts {
+		stats.FetchDurationCounts[i] = atomic.LoadUint64(&m.stats.fetchDurationCounts[i])
+	}
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		stats.Bytes += s.bytes
+		s.itemsLock.RUnlock()
+	}
+	return
+}
+
+// ResetStats zeroes all of the counters. InFlight and Queued are what's going
+// on right now and aren't reset
+func (m *Cache) ResetStats() {
+	atomic.StoreUint64(&m.stats.hits, 0)
+	atomic.StoreUint64(&m.stats.misses, 0)
+	atomic.StoreUint64(&m.stats.fetches, 0)
+	atomic.StoreUint64(&m.stats.fetchErrors, 0)
+	atomic.StoreUint64(&m.stats.herdWaits, 0)
+	atomic.StoreUint64(&m.stats.evictions, 0)
+	atomic.StoreUint64(&m.stats.eventsDropped, 0)
+	atomic.StoreUint64(&m.stats.fetchNanos, 0)
+	for i := range m.stats.fetchDurationCounts {
+		atomic.StoreUint64(&m.stats.fetchDurationCounts[i], 0)
+	}
+}
+
+func (m *Cache) count(counter *uint64) {
+	if m.statsEnabled {
+		atomic.AddUint64(counter, 1)
+	}
+}
+
+// gauge adds delta to one of the gauges
+func (m *Cache) gauge(gauge *int64, delta int64) {
+	if m.statsEnabled {
+		atomic.AddInt64(gauge, delta)
+	}
+}
+
+// observeFetch records how long a fetch took
+func (m *Cache) observeFetch(d time.Duration) {
+	if !m.statsEnabled {
+		return
+	}
+	atomic.AddUint64(&m.stats.fetchNanos, uint64(d))
+	for i, bucket := range FetchDurationBuckets {
+		if d <= bucket {
+			atomic.AddUint64(&m.stats.fetchDurationCounts[i], 1)
+			return
+		}
+	}
+}
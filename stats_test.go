@@ -0,0 +1,144 @@
+package tcache
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	cache, _ := New(getMd5Value, WithStats())
+	cache.Get("1") // miss + fetch
+	cache.Get("1") // hit
+	cache.Get("2") // miss + fetch
+	want := Stats{Hits: 1, Misses: 2, Fetches: 2}
+	if stats := counts(cache.Stats()); stats != want {
+		t.Fatalf("stats: %+v, want %+v", stats, want)
+	}
+
+	// fetch errors are counted separately from the fetch itself
+	testErr := errors.New("error")
+	cache, _ = New(func(key string) (interface{}, error) {
+		return nil, testErr
+	}, WithStats())
+	if _, err := cache.Get("1"); !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+	want = Stats{Misses: 1, Fetches: 1, FetchErrors: 1}
+	if stats := counts(cache.Stats()); stats != want {
+		t.Fatalf("stats: %+v, want %+v", stats, want)
+	}
+
+	// every Get is either a hit or a miss, even when slammed
+	cache, _ = New(getMd5Value, WithPreWarm(preWarm), WithStats())
+	wg := &sync.WaitGroup{}
+	slam1To10ALot(cache, wg)
+	wg.Wait()
+	stats := cache.Stats()
+	if stats.Hits+stats.Misses != 80000 {
+		t.Fatalf("hits+misses: %d, want 80000", stats.Hits+stats.Misses)
+	}
+}
+
+func TestStatsEvictions(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithMaxEntries(2), WithTTL(time.Minute), WithStats())
+	cache.now = func() time.Time { return now }
+	cache.Get("1")
+	cache.Get("2")
+	cache.Get("3") // evicts 1
+	cache.Delete("3")
+	cache.Clear()
+	if stats := cache.Stats(); stats.Evictions != 1 {
+		t.Fatalf("evictions: %d, want 1, deleting and clearing aren't evictions", stats.Evictions)
+	}
+
+	cache.Get("1")
+	now = now.Add(2 * time.Minute)
+	cache.Get("1") // expired
+	if stats := cache.Stats(); stats.Evictions != 2 {
+		t.Fatalf("evictions: %d, want 2", stats.Evictions)
+	}
+}
+
+func TestStatsFetchDuration(t *testing.T) {
+	cache, _ := New(func(key string) (interface{}, error) {
+		if key == "slow" {
+			time.Sleep(7 * time.Millisecond)
+		}
+		return key, nil
+	}, WithStats())
+	cache.Get("fast")
+	cache.Get("slow")
+	stats := cache.Stats()
+	if stats.FetchDuration < 7*time.Millisecond {
+		t.Fatalf("fetch duration: %v, want at least 7ms", stats.FetchDuration)
+	}
+	var total uint64
+	for _, n := range stats.FetchDurationCounts {
+		total += n
+	}
+	if total != 2 || stats.FetchDurationCounts[0] != 1 {
+		t.Fatalf("fetch duration counts: %v, want the fast fetch in the first bucket", stats.FetchDurationCounts)
+	}
+	cache.ResetStats()
+	if stats := cache.Stats(); stats != (Stats{}) {
+		t.Fatalf("stats: %+v, want all zeros", stats)
+	}
+}
+
+func TestStatsDisabled(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	cache.Get("1")
+	cache.Get("1")
+	if stats := cache.Stats(); stats != (Stats{}) {
+		t.Fatalf("stats: %+v, want all zeros without WithStats", stats)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	cache, _ := New(getMd5Value, WithStats())
+	cache.Get("1")
+	cache.Get("1")
+	cache.ResetStats()
+	if stats := cache.Stats(); stats != (Stats{}) {
+		t.Fatalf("stats: %+v, want all zeros", stats)
+	}
+}
+
+// counts clears the timings out of stats so the remaining counts can be
+// compared exactly
+func counts(stats Stats) Stats {
+	stats.FetchDuration = 0
+	stats.FetchDurationCounts = [len(FetchDurationBuckets)]uint64{}
+	return stats
+}
+
+func TestStatsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		<-release
+		return key, nil
+	}, WithMaxConcurrentFetches(2), WithStats())
+	wg := &sync.WaitGroup{}
+	for _, key := range []string{"1", "2", "3", "4", "5"} {
+		wg.Add(1)
+		go func(key string) {
+			cache.Get(key)
+			wg.Done()
+		}(key)
+	}
+	deadline := time.Now().Add(time.Second)
+	for stats := cache.Stats(); stats.InFlight != 2 || stats.Queued != 3; stats = cache.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("in flight: %d, queued: %d, want 2 and 3", stats.InFlight, stats.Queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if stats := cache.Stats(); stats.InFlight != 0 || stats.Queued != 0 {
+		t.Fatalf("in flight: %d, queued: %d, want 0 once done", stats.InFlight, stats.Queued)
+	}
+}
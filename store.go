@@ -0,0 +1,73 @@
+package tcache
+
+import "sync"
+
+// Store is a second tier behind the cache, set up with WithBackingStore. A
+// miss asks the store before calling fetch, and whatever fetch returns is
+// written to the store as well. Only the get fetching a key talks to the
+// store, the herd waiting on it is still held back by the cache. Update and
+// Refresh skip reading the store and fetch straight away. Values stored with
+// Set and friends stay in the cache, Delete removes a key from both.
+//
+// The store is an optimization, so failing to read from it falls back to
+// fetch and failing to write to it only means the key has to be fetched
+// elsewhere too. Errors from Delete are returned. StoreConformanceTest in
+// the tcachetest package checks an implementation against these semantics
+type Store interface {
+	Get(key string) (value interface{}, ok bool, err error)
+	Set(key string, value interface{}) error
+	Delete(key string) error
+}
+
+// throughStore wraps fetch so it goes through the backing store, if there is
+// one
+func (m *Cache) throughStore(fetch func(string) (interface{}, error), skipRead bool) func(string) (interface{}, error) {
+	if m.store == nil {
+		return fetch
+	}
+	return func(key string) (value interface{}, err error) {
+		if !skipRead {
+			var ok bool
+			if value, ok, err = m.store.Get(key); ok && err == nil {
+				return
+			}
+		}
+		if value, err = fetch(key); err != nil {
+			return
+		}
+		m.store.Set(key, value)
+		return
+	}
+}
+
+// MemoryStore is a Store keeping everything in a map, as a reference and for
+// tests
+type MemoryStore struct {
+	lock  sync.RWMutex
+	items map[string]interface{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(map[string]interface{})}
+}
+
+func (s *MemoryStore) Get(key string) (value interface{}, ok bool, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	value, ok = s.items[key]
+	return
+}
+
+func (s *MemoryStore) Set(key string, value interface{}) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.items[key] = value
+	return
+}
+
+func (s *MemoryStore) Delete(key string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.items, key)
+	return
+}
@@ -0,0 +1,60 @@
+package tcache
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// failingStore is a Store that's always down
+type failingStore struct{}
+
+var errStoreDown = errors.New("store is down")
+
+func (failingStore) Get(key string) (interface{}, bool, error) { return nil, false, errStoreDown }
+func (failingStore) Set(key string, value interface{}) error   { return errStoreDown }
+func (failingStore) Delete(key string) error                   { return errStoreDown }
+
+func TestBackingStore(t *testing.T) {
+	var fetches int64
+	fetch := func(key string) (interface{}, error) {
+		atomic.AddInt64(&fetches, 1)
+		return computeMD5(key), nil
+	}
+	store := NewMemoryStore()
+	first, _ := New(fetch, WithBackingStore(store))
+	second, _ := New(fetch, WithBackingStore(store))
+
+	// the second instance finds what the first one fetched in the store
+	first.Get("1")
+	if value, _ := second.Get("1"); !checkKey("1", value.(string)) || fetches != 1 {
+		t.Fatalf("value: %v, fetches: %d, want 1 from the store", value, fetches)
+	}
+
+	// a store miss fetches and writes through
+	second.Get("2")
+	if value, ok, _ := store.Get("2"); !ok || !checkKey("2", value.(string)) {
+		t.Fatalf("value: %v, want 2 written through", value)
+	}
+
+	// Update skips reading the store
+	fetches = 0
+	first.Update("1")
+	if fetches != 1 {
+		t.Fatalf("fetches: %d, want Update to fetch", fetches)
+	}
+
+	first.Delete("2")
+	if _, ok, _ := store.Get("2"); ok {
+		t.Fatal("Delete should remove the key from the store too")
+	}
+
+	// a failing store falls back to fetching
+	cache, _ := New(fetch, WithBackingStore(failingStore{}))
+	if value, err := cache.Get("1"); err != nil || !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, error: %v, want it fetched", value, err)
+	}
+	if err := cache.Delete("1"); err != errStoreDown {
+		t.Fatalf("error: %v, want %v", err, errStoreDown)
+	}
+}
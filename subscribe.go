@@ -0,0 +1,87 @@
+package tcache
+
+// EventType is what happened to the cache in an Event
+type EventType int
+
+const (
+	// EventSet is a value stored for Key, fetched or Set
+	EventSet EventType = iota
+	// EventDelete is Key removed by Delete, Invalidate or InvalidateFunc
+	EventDelete
+	// EventClear is every item removed at once by Clear, PurgeAndInit or
+	// ReplaceAll. It has no Key, the items stored afterwards by the last two
+	// follow as EventSets
+	EventClear
+	// EventEvict is Key dropped to make room or because it expired
+	EventEvict
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventClear:
+		return "clear"
+	case EventEvict:
+		return "evict"
+	}
+	return "unknown"
+}
+
+// Event is a change to the cache, as delivered by Subscribe
+type Event struct {
+	Type  EventType
+	Key   string
+	Value interface{}
+}
+
+// subscription is a channel handed out by Subscribe
+type subscription struct {
+	events chan Event
+}
+
+// returns a channel receiving every change to the cache, eg. to mirror them
+// to other instances, and a func that unsubscribes and closes the channel.
+// The channel buffers up to buffer events. Events are sent without ever
+// waiting, so a subscriber that falls behind misses the events that don't
+// fit in the buffer instead of slowing down the cache, Stats counts them.
+// The events of a key arrive in the order its changes were made
+func (m *Cache) Subscribe(buffer int) (events <-chan Event, unsubscribe func()) {
+	sub := &subscription{events: make(chan Event, buffer)}
+	m.callbacksLock.Lock()
+	m.subscriptions = append(m.subscriptions, sub)
+	m.callbacksLock.Unlock()
+
+	var done bool
+	return sub.events, func() {
+		m.callbacksLock.Lock()
+		defer m.callbacksLock.Unlock()
+		if done {
+			return
+		}
+		done = true
+		for i, s := range m.subscriptions {
+			if s == sub {
+				m.subscriptions = append(m.subscriptions[:i:i], m.subscriptions[i+1:]...)
+				break
+			}
+		}
+		close(sub.events)
+	}
+}
+
+// publish hands ev to every subscription that has room for it. Never
+// blocks, so it's fine to call with the shards locked
+func (m *Cache) publish(ev Event) {
+	m.callbacksLock.RLock()
+	defer m.callbacksLock.RUnlock()
+	for _, sub := range m.subscriptions {
+		select {
+		case sub.events <- ev:
+		default:
+			m.count(&m.stats.eventsDropped)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package tcacheprom exports the stats of a tcache.Cache as prometheus
+// metrics
+package tcacheprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	tcache "github.com/scrivy/thundering-cache"
+)
+
+type collector struct {
+	cache *tcache.Cache
+
+	hits          *prometheus.Desc
+	misses        *prometheus.Desc
+	fetchErrors   *prometheus.Desc
+	evictions     *prometheus.Desc
+	entries       *prometheus.Desc
+	fetchDuration *prometheus.Desc
+}
+
+// NewCollector returns a prometheus.Collector for cache, labeled
+// cache=<name> with the name given with tcache.WithName. The cache has to be
+// created with tcache.WithStats, otherwise every counter stays at zero
+func NewCollector(cache *tcache.Cache) prometheus.Collector {
+	labels := prometheus.Labels{"cache": cache.Name()}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("tcache_"+name, help, nil, labels)
+	}
+	return &collector{
+		cache:         cache,
+		hits:          desc("hits_total", "Gets served from the cache."),
+		misses:        desc("misses_total", "Gets that had to fetch or wait on a fetch."),
+		fetchErrors:   desc("fetch_errors_total", "Fetches that returned an error."),
+		evictions:     desc("evictions_total", "Items dropped by the lru or because they expired."),
+		entries:       desc("entries", "Items currently cached."),
+		fetchDuration: desc("fetch_duration_seconds", "How long fetches took."),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.fetchErrors
+	ch <- c.evictions
+	ch <- c.entries
+	ch <- c.fetchDuration
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	counter := func(desc *prometheus.Desc, n uint64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(n))
+	}
+	counter(c.hits, stats.Hits)
+	counter(c.misses, stats.Misses)
+	counter(c.fetchErrors, stats.FetchErrors)
+	counter(c.evictions, stats.Evictions)
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(c.cache.Len()))
+
+	// prometheus buckets are cumulative, the ones in Stats aren't
+	buckets := make(map[float64]uint64, len(tcache.FetchDurationBuckets))
+	var cumulative uint64
+	for i, bound := range tcache.FetchDurationBuckets {
+		cumulative += stats.FetchDurationCounts[i]
+		buckets[bound.Seconds()] = cumulative
+	}
+	ch <- prometheus.MustNewConstHistogram(c.fetchDuration, stats.Fetches, stats.FetchDuration.Seconds(), buckets)
+}
@@ -0,0 +1,27 @@
+package tcacheprom
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	tcache "github.com/scrivy/thundering-cache"
+)
+
+func TestCollector(t *testing.T) {
+	cache, _ := tcache.New(func(key string) (interface{}, error) {
+		return key, nil
+	}, tcache.WithName("test"), tcache.WithStats())
+	cache.Get("1")
+	cache.Get("1")
+
+	c := NewCollector(cache)
+	descs := make(chan *prometheus.Desc, 10)
+	c.Describe(descs)
+	close(descs)
+	metrics := make(chan prometheus.Metric, 10)
+	c.Collect(metrics)
+	close(metrics)
+	if len(descs) != 6 || len(metrics) != 6 {
+		t.Fatalf("descs: %d, metrics: %d, want 6 of each", len(descs), len(metrics))
+	}
+}
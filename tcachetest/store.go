@@ -0,0 +1,74 @@
+// Package tcachetest helps test code built around tcache, eg. Store
+// implementations
+package tcachetest
+
+import (
+	"testing"
+
+	tcache "github.com/scrivy/thundering-cache"
+)
+
+// StoreConformanceTest checks that the stores returned by newStore behave the
+// way a tcache.Cache expects its backing store to. newStore is called for
+// every subtest and must return an empty store each time
+func StoreConformanceTest(t *testing.T, newStore func() tcache.Store) {
+	t.Run("GetMissing", func(t *testing.T) {
+		store := newStore()
+		if value, ok, err := store.Get("missing"); ok || err != nil {
+			t.Fatalf("value: %v, ok: %v, error: %v, want a miss", value, ok, err)
+		}
+	})
+
+	t.Run("GetAfterSet", func(t *testing.T) {
+		store := newStore()
+		if err := store.Set("1", "one"); err != nil {
+			t.Fatalf("error: %v, want nil", err)
+		}
+		if value, ok, err := store.Get("1"); !ok || err != nil || value != "one" {
+			t.Fatalf("value: %v, ok: %v, error: %v, want one", value, ok, err)
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		store := newStore()
+		store.Set("1", "one")
+		store.Set("1", "uno")
+		if value, ok, err := store.Get("1"); !ok || err != nil || value != "uno" {
+			t.Fatalf("value: %v, ok: %v, error: %v, want uno", value, ok, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore()
+		store.Set("1", "one")
+		store.Set("2", "two")
+		if err := store.Delete("1"); err != nil {
+			t.Fatalf("error: %v, want nil", err)
+		}
+		if _, ok, err := store.Get("1"); ok || err != nil {
+			t.Fatalf("ok: %v, error: %v, want 1 deleted", ok, err)
+		}
+		if value, ok, _ := store.Get("2"); !ok || value != "two" {
+			t.Fatalf("value: %v, want two left alone", value)
+		}
+		// deleting a missing key isn't an error
+		if err := store.Delete("missing"); err != nil {
+			t.Fatalf("error: %v, want nil", err)
+		}
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		var fetches int
+		fetch := func(key string) (interface{}, error) {
+			fetches++
+			return key, nil
+		}
+		store := newStore()
+		first, _ := tcache.New(fetch, tcache.WithBackingStore(store))
+		second, _ := tcache.New(fetch, tcache.WithBackingStore(store))
+		first.Get("1")
+		if value, err := second.Get("1"); err != nil || value != "1" || fetches != 1 {
+			t.Fatalf("value: %v, error: %v, fetches: %d, want 1 from the store", value, err, fetches)
+		}
+	})
+}
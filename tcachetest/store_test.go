@@ -0,0 +1,13 @@
+package tcachetest
+
+import (
+	"testing"
+
+	tcache "github.com/scrivy/thundering-cache"
+)
+
+func TestMemoryStore(t *testing.T) {
+	StoreConformanceTest(t, func() tcache.Store {
+		return tcache.NewMemoryStore()
+	})
+}
@@ -0,0 +1,272 @@
+package tcache
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// entry wraps every cached value with its expiry
+type entry struct {
+	value     interface{}
+	storedAt  time.Time         // when the value was stored
+	expiresAt time.Time         // zero when the entry never expires
+	refreshAt time.Time         // past it a hit refreshes the entry in the background, see WithSoftTTL
+	elem      *list.Element     // position in the lru or frequency list, nil when unbounded
+	freq      *list.Element     // the entry's frequency in shard.freqs, lfu only
+	meta      map[string]string // set by SetWithMeta, never modified
+	size      int64             // estimated bytes, only set with maxBytes
+	gen       uint64            // bumped by every write, see GetWithGen
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// expiry returns when a value stored right now should expire
+func (m *Cache) expiry() time.Time {
+	if m.ttl <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(m.jitter(m.ttl))
+}
+
+// softExpiry returns when a value stored right now should start being
+// refreshed in the background, the zero time without WithSoftTTL
+func (m *Cache) softExpiry() time.Time {
+	if m.softTTL <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(m.jitter(m.softTTL))
+}
+
+// stale reports whether a hit on e should refresh it in the background
+func (e *entry) stale(now time.Time) bool {
+	return !e.refreshAt.IsZero() && now.After(e.refreshAt)
+}
+
+// refreshInBackground fetches key again in its own goroutine for a hit on a
+// stale entry, unless key is already being fetched or has been refreshed
+// since. The value keeps being served until the fetch stores its result, a
+// failing fetch leaves it alone. Gets that miss in the meantime, because key
+// expired or was deleted, wait on the refresh like on any other fetch
+func (m *Cache) refreshInBackground(key string) {
+	if _, inflight := m.calls.Load(key); inflight {
+		return
+	}
+	go func() {
+		fresh := func(e entry) bool { return !e.stale(m.now()) }
+		if _, err := m.fetchInBackground(key, fresh); err != nil {
+			m.log("refreshing stale "+key, err)
+		}
+	}()
+}
+
+// jitter spreads ttl by up to ±ttlJitter of it
+func (m *Cache) jitter(ttl time.Duration) time.Duration {
+	if m.ttlJitter <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(float64(ttl)*m.ttlJitter*(2*rand.Float64()-1))
+}
+
+// removeExpired drops every expired item, returning how many there were
+func (s *shard) removeExpired(now time.Time) (removed int) {
+	s.itemsLock.Lock()
+	defer s.unlock()
+	for k, e := range s.items {
+		if e.expired(now) {
+			s.cache.count(&s.cache.stats.evictions)
+			s.remove(k, e, ReasonTTL)
+			removed++
+		}
+	}
+	return
+}
+
+// startCleanup runs the janitor set up by WithCleanupInterval
+func (m *Cache) startCleanup() {
+	if m.cleanupInterval <= 0 {
+		return
+	}
+	m.track(m.cleanupInterval, func(done <-chan struct{}) {
+		removed := 0
+		defer func() {
+			if removed > 0 {
+				m.log(fmt.Sprintf("cleanup removed %d expired items", removed), nil)
+			}
+		}()
+		for _, s := range m.shards {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			removed += s.removeExpired(m.now().Add(-m.staleRetention))
+		}
+	})
+}
+
+// like Set, but the value expires after ttl instead of the cache's default
+// ttl. A ttl of 0 uses the default and a negative ttl never expires
+func (m *Cache) SetWithTTL(key string, value interface{}, ttl time.Duration) (err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	s := m.shardFor(key)
+	s.itemsLock.Lock()
+	defer s.unlock()
+	m.overrideFetch(key, s.storeUntil(key, value, m.expiryAfter(ttl)))
+	return
+}
+
+// expiryAfter is expiry with an explicit ttl, see SetWithTTL for what 0 and
+// negative values mean
+func (m *Cache) expiryAfter(ttl time.Duration) time.Time {
+	switch {
+	case ttl == 0:
+		return m.expiry()
+	case ttl < 0:
+		return time.Time{}
+	}
+	return m.now().Add(m.jitter(ttl))
+}
+
+// like Get, but also returns when the value expires. expiresAt is the zero
+// time for values that never expire
+func (m *Cache) GetWithExpiry(key string) (value interface{}, expiresAt time.Time, err error) {
+	e, _, err := m.doFetch(key, false, m.currentFetch())
+	return m.copyValue(e.value), e.expiresAt, err
+}
+
+// like Get, but a value stored more than maxAge ago is fetched again, just
+// for this get, as if by Refresh. The value stays cached for gets that don't
+// mind its age, so callers can each have their own idea of fresh enough
+func (m *Cache) GetFresherThan(key string, maxAge time.Duration) (value interface{}, err error) {
+	if err = m.usable(); err != nil {
+		return
+	}
+	if e, ok := m.shardFor(key).lookup(key); ok && m.now().Sub(e.storedAt) <= maxAge {
+		m.count(&m.stats.hits)
+		return m.copyValue(e.value), nil
+	}
+	e, _, err := m.doFetch(key, true, m.currentFetch())
+	return m.copyValue(e.value), err
+}
+
+// like Get, but when fetching key fails and an expired value of it is still
+// around, that value is returned with stale set instead of the error. Expired
+// items are kept until they're fetched again successfully, evicted, or swept
+// by WithCleanupInterval's janitor, see WithStaleRetention to keep them from
+// the janitor for longer
+func (m *Cache) GetWithFallback(key string) (value interface{}, stale bool, err error) {
+	e, _, err := m.doFetch(key, false, m.currentFetch())
+	if err == nil {
+		return m.copyValue(e.value), false, nil
+	}
+	s := m.shardFor(key)
+	if s == nil {
+		return
+	}
+	s.itemsLock.RLock()
+	stored, ok := s.items[key]
+	if ok {
+		value = stored.value
+	}
+	s.itemsLock.RUnlock()
+	if !ok {
+		return
+	}
+	return m.copyValue(value), true, nil
+}
+
+// EntryInfo is a cached value along with its age, as returned by
+// SnapshotWithAges
+type EntryInfo struct {
+	Value     interface{}
+	StoredAt  time.Time
+	ExpiresAt time.Time // zero when the value never expires
+}
+
+// like Snapshot, but with when each item was stored and when it expires, eg.
+// to tell which of two diverging caches has the fresher value
+func (m *Cache) SnapshotWithAges() map[string]EntryInfo {
+	if m.shards == nil {
+		return nil
+	}
+	now := m.now()
+	items := map[string]EntryInfo{}
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		for k, e := range s.items {
+			if !e.expired(now) {
+				items[k] = EntryInfo{m.copyValue(e.value), e.storedAt, e.expiresAt}
+			}
+		}
+		s.itemsLock.RUnlock()
+	}
+	return items
+}
+
+// the cached key that was stored the longest ago and how long ago that was,
+// ignoring expired items. ok is false when nothing is cached. Together with
+// NewestEntry it tells whether the ttl fits the working set
+func (m *Cache) OldestEntry() (key string, age time.Duration, ok bool) {
+	return m.entryByAge(func(a, b time.Time) bool { return a.Before(b) })
+}
+
+// like OldestEntry, but the key that was stored most recently
+func (m *Cache) NewestEntry() (key string, age time.Duration, ok bool) {
+	return m.entryByAge(func(a, b time.Time) bool { return a.After(b) })
+}
+
+// entryByAge finds the unexpired item whose storedAt wins over every other
+// one according to better
+func (m *Cache) entryByAge(better func(a, b time.Time) bool) (key string, age time.Duration, ok bool) {
+	if m.shards == nil {
+		return
+	}
+	now := m.now()
+	var storedAt time.Time
+	for _, s := range m.shards {
+		s.itemsLock.RLock()
+		for k, e := range s.items {
+			if !e.expired(now) && (!ok || better(e.storedAt, storedAt)) {
+				key, storedAt, ok = k, e.storedAt, true
+			}
+		}
+		s.itemsLock.RUnlock()
+	}
+	if ok {
+		age = now.Sub(storedAt)
+	}
+	return
+}
+
+// restarts the ttl of key as if it had just been stored, without fetching it,
+// eg. to keep a session alive. Reports whether key is cached and hasn't
+// expired. Keys stored with SetWithTTL get the default ttl too, and without
+// WithTTL there's nothing to extend
+func (m *Cache) Touch(key string) bool {
+	s := m.shardFor(key)
+	if s == nil {
+		return false
+	}
+	s.itemsLock.Lock()
+	defer s.itemsLock.Unlock()
+	e, ok := s.items[key]
+	if !ok || e.expired(m.now()) {
+		return false
+	}
+	m.extend(e)
+	return true
+}
+
+// extend restarts the ttl of e unless it never expires. Must be called with
+// the itemsLock of e's shard held for writing
+func (m *Cache) extend(e *entry) {
+	if !e.expiresAt.IsZero() && m.ttl > 0 {
+		e.expiresAt = m.expiry()
+	}
+}
@@ -0,0 +1,429 @@
+package tcache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	var calls int
+	now := time.Now()
+	cache, _ := New(func(key string) (interface{}, error) {
+		calls++
+		return calls, nil
+	}, WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+
+	cache.Get("1")
+	now = now.Add(30 * time.Second)
+	if value, _ := cache.Get("1"); value != 1 {
+		t.Fatalf("value: %v, want 1", value)
+	}
+
+	// expired items get fetched again
+	now = now.Add(31 * time.Second)
+	if value, _ := cache.Get("1"); value != 2 {
+		t.Fatalf("value: %v, want 2", value)
+	}
+
+	// Set starts a new ttl too
+	cache.Set("2", "two")
+	now = now.Add(61 * time.Second)
+	if value, _ := cache.Get("2"); value != 3 {
+		t.Fatalf("value: %v, want 3", value)
+	}
+
+	// without a ttl nothing expires
+	cache, _ = New(getMd5Value)
+	cache.Set("1", "one")
+	cache.now = func() time.Time { return now.Add(24 * time.Hour) }
+	if value, _ := cache.Get("1"); value != "one" {
+		t.Fatalf("value: %v, want one", value)
+	}
+}
+
+func TestSoftTTL(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	cache, _ := New(func(key string) (interface{}, error) {
+		n := atomic.AddInt64(&calls, 1)
+		if n > 1 {
+			<-release
+		}
+		return n, nil
+	}, WithTTL(time.Minute), WithSoftTTL(30*time.Second))
+	var lock sync.Mutex
+	now := time.Now()
+	cache.now = func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		lock.Lock()
+		now = now.Add(d)
+		lock.Unlock()
+	}
+
+	cache.Get("1")
+	advance(20 * time.Second)
+	if value, _ := cache.Get("1"); value.(int64) != 1 || atomic.LoadInt64(&calls) != 1 {
+		t.Fatalf("value: %v, calls: %d, want 1 before the soft ttl", value, calls)
+	}
+
+	// past the soft ttl gets are served the old value while a single fetch
+	// refreshes it
+	advance(20 * time.Second)
+	for i := 0; i < 10; i++ {
+		if value, _ := cache.Get("1"); value.(int64) != 1 {
+			t.Fatalf("value: %v, want 1 while refreshing", value)
+		}
+	}
+	close(release)
+	for {
+		if value, _ := cache.Get("1"); value.(int64) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Fatalf("calls: %d, want a single background fetch", n)
+	}
+
+	// past the ttl it's an ordinary miss
+	advance(61 * time.Second)
+	if value, _ := cache.Get("1"); value.(int64) != 3 {
+		t.Fatalf("value: %v, want 3", value)
+	}
+
+	// a get missing while a refresh runs waits on it, and gets its error
+	// when it fails
+	testErr := errors.New("error")
+	var refreshes int64
+	started := make(chan struct{})
+	release = make(chan struct{})
+	cache, _ = New(func(key string) (interface{}, error) {
+		if atomic.AddInt64(&refreshes, 1) == 1 {
+			return "one", nil
+		}
+		close(started)
+		<-release
+		return nil, testErr
+	}, WithTTL(time.Minute), WithSoftTTL(30*time.Second), WithStats())
+	cache.now = func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}
+	cache.Get("1")
+	advance(40 * time.Second)
+	cache.Get("1")
+	<-started
+	cache.Delete("1")
+	errs := make(chan error)
+	go func() {
+		_, err := cache.Get("1")
+		errs <- err
+	}()
+	for cache.Stats().HerdWaits != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-errs; !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v", err, testErr)
+	}
+}
+
+func TestTTLPreWarm(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm), WithTTL(time.Minute), WithStats())
+	cache.now = func() time.Time { return now.Add(2 * time.Minute) }
+	for k, v := range preWarmMap {
+		if value, _ := cache.Get(k); value != v {
+			t.Fatalf("value: %v, want %v", value, v)
+		}
+	}
+	if stats := cache.Stats(); stats.Fetches != uint64(len(preWarmMap)) {
+		t.Fatalf("fetches: %d, want every prewarmed item to be fetched again", stats.Fetches)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+	cache.SetWithTTL("short", "short", time.Second)
+	cache.SetWithTTL("default", "default", 0)
+	cache.SetWithTTL("long", "long", time.Hour)
+	cache.SetWithTTL("forever", "forever", -1)
+
+	present := func(want ...string) {
+		t.Helper()
+		for _, key := range []string{"short", "default", "long", "forever"} {
+			has := false
+			for _, w := range want {
+				has = has || w == key
+			}
+			if cache.Has(key) != has {
+				t.Fatalf("key %s present: %v, want %v", key, !has, has)
+			}
+		}
+	}
+	present("short", "default", "long", "forever")
+	now = now.Add(2 * time.Second)
+	present("default", "long", "forever")
+	now = now.Add(2 * time.Minute)
+	present("long", "forever")
+	now = now.Add(2 * time.Hour)
+	present("forever")
+
+	cache = &Cache{}
+	if err := cache.SetWithTTL("1", "one", time.Second); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestGetWithExpiry(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+
+	// fetched on a miss
+	value, expiresAt, err := cache.GetWithExpiry("1")
+	if err != nil {
+		t.Fatalf("error: %v, want nil", err)
+	}
+	if !checkKey("1", value.(string)) || !expiresAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("value: %v, expires at: %v, want %s, %v", value, expiresAt, computeMD5("1"), now.Add(time.Minute))
+	}
+
+	// served from the cache
+	cache.SetWithTTL("2", "two", time.Hour)
+	now = now.Add(time.Second)
+	value, expiresAt, _ = cache.GetWithExpiry("2")
+	if value != "two" || !expiresAt.Equal(now.Add(time.Hour-time.Second)) {
+		t.Fatalf("value: %v, expires at: %v, want two, %v", value, expiresAt, now.Add(time.Hour-time.Second))
+	}
+
+	// never expires
+	cache.SetWithTTL("3", "three", -1)
+	if _, expiresAt, _ = cache.GetWithExpiry("3"); !expiresAt.IsZero() {
+		t.Fatalf("expires at: %v, want the zero time", expiresAt)
+	}
+
+	cache = &Cache{}
+	if _, _, err := cache.GetWithExpiry("1"); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestCleanupInterval(t *testing.T) {
+	cache, _ := New(getMd5Value, WithTTL(10*time.Millisecond), WithCleanupInterval(time.Millisecond))
+	evicted := make(chan string, 2)
+	cache.OnEvict(func(key string, value interface{}) {
+		evicted <- key
+	})
+	cache.Get("1")
+	cache.SetWithTTL("2", "forever", -1)
+
+	select {
+	case key := <-evicted:
+		if key != "1" {
+			t.Fatalf("evicted: %v, want 1", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the expired item was never swept")
+	}
+	if keys := cache.Keys(); len(keys) != 1 || keys[0] != "2" {
+		t.Fatalf("keys: %v, want [2]", keys)
+	}
+
+	// nothing is swept after Close
+	cache.SetWithTTL("3", "soon", 10*time.Millisecond)
+	cache.Close()
+	time.Sleep(30 * time.Millisecond)
+	if cache.Len() != 2 {
+		t.Fatalf("len: %d, want 2 after Close", cache.Len())
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithTTL(time.Minute), WithTTLJitter(0.1))
+	cache.now = func() time.Time { return now }
+	expiries := map[time.Time]bool{}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if i%2 == 0 {
+			cache.Get(key)
+		} else {
+			cache.SetWithTTL(key, "value", time.Minute)
+		}
+		_, expiresAt, _ := cache.GetWithExpiry(key)
+		ttl := expiresAt.Sub(now)
+		if ttl < 54*time.Second || ttl > 66*time.Second {
+			t.Fatalf("ttl: %v, want within 10%% of a minute", ttl)
+		}
+		expiries[expiresAt] = true
+	}
+	if len(expiries) < 50 {
+		t.Fatalf("distinct expiries: %d, want them spread out", len(expiries))
+	}
+
+	// entries that never expire stay that way
+	cache.SetWithTTL("forever", "value", -1)
+	if _, expiresAt, _ := cache.GetWithExpiry("forever"); !expiresAt.IsZero() {
+		t.Fatalf("expires at: %v, want never", expiresAt)
+	}
+}
+
+func TestEntryAge(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithTTL(time.Hour))
+	cache.now = func() time.Time { return now }
+	if _, _, ok := cache.OldestEntry(); ok {
+		t.Fatal("ok: true, want false for an empty cache")
+	}
+
+	cache.SetWithTTL("expired", 0, time.Second)
+	now = now.Add(time.Minute)
+	cache.Set("old", 1)
+	now = now.Add(time.Minute)
+	cache.Set("new", 2)
+	now = now.Add(time.Minute)
+	if key, age, ok := cache.OldestEntry(); !ok || key != "old" || age != 2*time.Minute {
+		t.Fatalf("oldest: %s, %v, %v, want old, 2m0s, true", key, age, ok)
+	}
+	if key, age, ok := cache.NewestEntry(); !ok || key != "new" || age != time.Minute {
+		t.Fatalf("newest: %s, %v, %v, want new, 1m0s, true", key, age, ok)
+	}
+
+	cache = &Cache{}
+	if _, _, ok := cache.NewestEntry(); ok {
+		t.Fatal("ok: true, want false for an uninitialized cache")
+	}
+}
+
+func TestSnapshotWithAges(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithTTL(time.Hour))
+	cache.now = func() time.Time { return now }
+	start := now
+	cache.SetWithTTL("expired", 0, time.Second)
+	cache.SetWithTTL("forever", 1, -1)
+	now = now.Add(time.Minute)
+	cache.Set("new", 2)
+	now = now.Add(time.Minute)
+
+	got := cache.SnapshotWithAges()
+	want := map[string]EntryInfo{
+		"forever": {1, start, time.Time{}},
+		"new":     {2, start.Add(time.Minute), start.Add(time.Minute + time.Hour)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("snapshot: %v, want %v", got, want)
+	}
+	for k, info := range want {
+		if g := got[k]; g.Value != info.Value || !g.StoredAt.Equal(info.StoredAt) || !g.ExpiresAt.Equal(info.ExpiresAt) {
+			t.Fatalf("%s: %+v, want %+v", k, g, info)
+		}
+	}
+
+	cache = &Cache{}
+	if got := cache.SnapshotWithAges(); got != nil {
+		t.Fatalf("snapshot: %v, want nil for an uninitialized cache", got)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	now := time.Now()
+	cache, _ := New(getMd5Value, WithTTL(time.Minute))
+	cache.now = func() time.Time { return now }
+	cache.Set("1", "one")
+	now = now.Add(50 * time.Second)
+	if !cache.Touch("1") || cache.Touch("2") {
+		t.Fatal("touch: want true for 1 and false for 2")
+	}
+	now = now.Add(50 * time.Second)
+	if value, _ := cache.TryGet("1"); value != "one" {
+		t.Fatalf("value: %v, want one to still be cached", value)
+	}
+	now = now.Add(11 * time.Second)
+	if cache.Touch("1") {
+		t.Fatal("touch: true, want false once expired")
+	}
+
+	// sliding expiration touches on every hit
+	cache, _ = New(getMd5Value, WithTTL(time.Minute), WithSlidingExpiration(true))
+	cache.now = func() time.Time { return now }
+	cache.Set("1", "one")
+	for i := 0; i < 3; i++ {
+		now = now.Add(50 * time.Second)
+		if value, _ := cache.Get("1"); value != "one" {
+			t.Fatalf("value: %v, want one", value)
+		}
+	}
+	now = now.Add(61 * time.Second)
+	if cache.Has("1") {
+		t.Fatal("1 should have expired a minute after the last get")
+	}
+}
+
+func TestGetFresherThan(t *testing.T) {
+	var calls int
+	now := time.Now()
+	cache, _ := New(func(key string) (interface{}, error) {
+		calls++
+		return calls, nil
+	})
+	cache.now = func() time.Time { return now }
+
+	cache.Get("1")
+	now = now.Add(time.Minute)
+	if value, err := cache.GetFresherThan("1", 2*time.Minute); err != nil || value != 1 {
+		t.Fatalf("value: %v, error: %v, want the cached 1", value, err)
+	}
+	if value, _ := cache.GetFresherThan("1", 30*time.Second); value != 2 {
+		t.Fatalf("value: %v, want 2 fetched again", value)
+	}
+	if value, _ := cache.Get("1"); value != 2 {
+		t.Fatalf("value: %v, want 2 cached for everyone", value)
+	}
+	// a miss is fetched like with Get
+	if value, _ := cache.GetFresherThan("2", time.Minute); value != 3 {
+		t.Fatalf("value: %v, want 3", value)
+	}
+}
+
+func TestGetWithFallback(t *testing.T) {
+	fail := false
+	testErr := errors.New("error")
+	cache, _ := New(func(key string) (interface{}, error) {
+		if fail {
+			return nil, testErr
+		}
+		return computeMD5(key), nil
+	}, WithTTL(time.Millisecond), WithCleanupInterval(time.Millisecond), WithStaleRetention(time.Hour))
+	defer cache.Close()
+
+	if value, stale, err := cache.GetWithFallback("1"); err != nil || stale || value != computeMD5("1") {
+		t.Fatalf("value: %v, stale: %v, error: %v, want a fresh %s", value, stale, err, computeMD5("1"))
+	}
+	// the janitor leaves the expired value alone for the failing fetch
+	time.Sleep(20 * time.Millisecond)
+	fail = true
+	if value, stale, err := cache.GetWithFallback("1"); err != nil || !stale || value != computeMD5("1") {
+		t.Fatalf("value: %v, stale: %v, error: %v, want a stale %s", value, stale, err, computeMD5("1"))
+	}
+	if _, err := cache.Get("1"); !errors.Is(err, testErr) {
+		t.Fatalf("error: %v, want %v from Get", err, testErr)
+	}
+	// with nothing to fall back on the error is returned
+	if value, stale, err := cache.GetWithFallback("2"); !errors.Is(err, testErr) || stale || value != nil {
+		t.Fatalf("value: %v, stale: %v, error: %v, want %v", value, stale, err, testErr)
+	}
+}
@@ -0,0 +1,50 @@
+package tcache
+
+import "fmt"
+
+// typed accessors that save asserting the type of what Get returns. A value
+// of another type gets an error wrapping ErrTypeMismatch
+
+// like Get, for string values
+func (m *Cache) GetString(key string) (value string, err error) {
+	v, err := m.Get(key)
+	if err != nil {
+		return
+	}
+	value, ok := v.(string)
+	if !ok {
+		err = m.mismatch(key, v, value)
+	}
+	return
+}
+
+// like Get, for int values
+func (m *Cache) GetInt(key string) (value int, err error) {
+	v, err := m.Get(key)
+	if err != nil {
+		return
+	}
+	value, ok := v.(int)
+	if !ok {
+		err = m.mismatch(key, v, value)
+	}
+	return
+}
+
+// like Get, for []byte values
+func (m *Cache) GetBytes(key string) (value []byte, err error) {
+	v, err := m.Get(key)
+	if err != nil {
+		return
+	}
+	value, ok := v.([]byte)
+	if !ok {
+		err = m.mismatch(key, v, value)
+	}
+	return
+}
+
+// mismatch is the error for a value of key that isn't of the wanted type
+func (m *Cache) mismatch(key string, value, wanted interface{}) error {
+	return m.named(fmt.Errorf("%w: %s is %T, not %T", ErrTypeMismatch, key, value, wanted))
+}
@@ -0,0 +1,38 @@
+package tcache
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetTyped(t *testing.T) {
+	cache, _ := New(getMd5Value)
+	cache.Set("int", 1)
+	cache.Set("bytes", []byte("b"))
+
+	if value, err := cache.GetString("1"); err != nil || !checkKey("1", value) {
+		t.Fatalf("value: %v, error: %v, want %s", value, err, computeMD5("1"))
+	}
+	if value, err := cache.GetInt("int"); err != nil || value != 1 {
+		t.Fatalf("value: %v, error: %v, want 1", value, err)
+	}
+	if value, err := cache.GetBytes("bytes"); err != nil || string(value) != "b" {
+		t.Fatalf("value: %v, error: %v, want b", value, err)
+	}
+
+	value, err := cache.GetInt("1")
+	if !errors.Is(err, ErrTypeMismatch) || value != 0 {
+		t.Fatalf("value: %v, error: %v, want %v", value, err, ErrTypeMismatch)
+	}
+	if err.Error() != "cached value has a different type: 1 is string, not int" {
+		t.Fatalf("error: %v, want it to name both types", err)
+	}
+	if _, err := cache.GetString("int"); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("error: %v, want %v", err, ErrTypeMismatch)
+	}
+
+	cache = &Cache{}
+	if _, err := cache.GetString("1"); err != ErrNotInitialized {
+		t.Fatalf("error: %v, want %v", err, ErrNotInitialized)
+	}
+}
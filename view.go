@@ -0,0 +1,45 @@
+package tcache
+
+// View is a read-only snapshot of the cache, see Cache.View. The zero View is
+// empty
+type View struct {
+	items map[string]interface{}
+}
+
+// returns a View of every cached item that hasn't expired, taken like
+// Snapshot. Later changes to the cache don't show up in it. Values are shared
+// with the cache unless WithValueCopier is used, so they still mustn't be
+// mutated
+func (m *Cache) View() View {
+	return View{items: m.Snapshot()}
+}
+
+// the value for key, ok is false if it wasn't cached
+func (v View) Get(key string) (value interface{}, ok bool) {
+	value, ok = v.items[key]
+	return
+}
+
+// number of items in the view
+func (v View) Len() int {
+	return len(v.items)
+}
+
+// keys in the view in no particular order
+func (v View) Keys() []string {
+	keys := make([]string, 0, len(v.items))
+	for k := range v.items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// calls fn for every item in no particular order, stopping early when fn
+// returns false
+func (v View) Range(fn func(key string, value interface{}) bool) {
+	for k, value := range v.items {
+		if !fn(k, value) {
+			return
+		}
+	}
+}
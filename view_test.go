@@ -0,0 +1,44 @@
+package tcache
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestView(t *testing.T) {
+	cache, _ := New(getMd5Value, WithPreWarm(preWarm))
+	view := cache.View()
+	cache.Set("11", "eleven")
+	cache.Delete("1")
+
+	if view.Len() != len(preWarmMap) {
+		t.Fatalf("len: %d, want %d, later changes don't show up", view.Len(), len(preWarmMap))
+	}
+	if value, ok := view.Get("1"); !ok || !checkKey("1", value.(string)) {
+		t.Fatalf("value: %v, ok: %v, want %s", value, ok, computeMD5("1"))
+	}
+	if _, ok := view.Get("11"); ok {
+		t.Fatal("11 was set after the view was taken")
+	}
+	keys := view.Keys()
+	sort.Strings(keys)
+	if len(keys) != len(preWarmMap) || keys[0] != "1" {
+		t.Fatalf("keys: %v, want the prewarmed keys", keys)
+	}
+	n := 0
+	view.Range(func(key string, value interface{}) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("visited: %d, want Range to stop after 3", n)
+	}
+
+	var empty View
+	if _, ok := empty.Get("1"); ok || empty.Len() != 0 || len(empty.Keys()) != 0 {
+		t.Fatal("the zero View is empty")
+	}
+	if view := (&Cache{}).View(); view.Len() != 0 {
+		t.Fatal("an uninitialized cache has an empty view")
+	}
+}